@@ -6,11 +6,17 @@ import (
 	"sync"
 )
 
+// ErrNoWeight is returned by ServiceCluster.Next when the only started
+// instances have a weight of 0.
+var ErrNoWeight = errors.New("no instance with a non-zero weight")
+
 type ServiceCluster struct {
 	Name      string     `json:"name"`
 	Instances []*Service `json:"instances"`
-	lastIndex int
-	lock      sync.RWMutex
+	// Current weights of the instances for the weighted round robin, by
+	// index
+	currentWeights map[string]int
+	lock           sync.RWMutex
 }
 
 func NewServiceCluster(name string) *ServiceCluster {
@@ -20,28 +26,60 @@ func NewServiceCluster(name string) *ServiceCluster {
 	return sc
 }
 
+// Next returns the instance to route the next request to, by smooth weighted
+// round robin over the started instances that have a location: an instance
+// of weight 3 is returned 3 times as often as an instance of weight 1, the
+// two being interleaved. Instances of weight 0 are never returned.
 func (cl *ServiceCluster) Next() (*Service, error) {
 	if cl == nil {
 		return nil, StatusError{}
 	}
-	cl.lock.RLock()
-	defer cl.lock.RUnlock()
+	// The current weights are updated, so Next needs the write lock
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
 	if len(cl.Instances) == 0 {
 		return nil, errors.New("no alive instance found")
 	}
-	var instance *Service
-	for tries := 0; tries < len(cl.Instances); tries++ {
-		index := (cl.lastIndex + 1) % len(cl.Instances)
-		cl.lastIndex = index
-
-		instance = cl.Instances[index]
-		glog.V(5).Infof("Checking instance %d Status : %s", index, instance.Status.Compute())
-		if instance.Status.Compute() == STARTED_STATUS && instance.Location.IsFullyDefined() {
-			return instance, nil
+	if cl.currentWeights == nil {
+		cl.currentWeights = make(map[string]int)
+	}
+
+	var selected, unavailable *Service
+	weightless := false
+	total := 0
+	for index, instance := range cl.Instances {
+		weight := instance.Config.GetWeight()
+		computed := instance.Status.Compute()
+		glog.V(5).Infof("Checking instance %d Status : %s, weight : %d", index, computed, weight)
+		if weight == 0 || computed != STARTED_STATUS || !instance.Location.IsFullyDefined() {
+			// Instances coming back start from scratch
+			delete(cl.currentWeights, instance.Index)
+			if computed == STARTED_STATUS && instance.Location.IsFullyDefined() {
+				weightless = true
+			} else {
+				unavailable = instance
+			}
+			continue
 		}
 
+		cl.currentWeights[instance.Index] += weight
+		total += weight
+		if selected == nil || cl.currentWeights[instance.Index] > cl.currentWeights[selected.Index] {
+			selected = instance
+		}
+	}
+	if selected != nil {
+		cl.currentWeights[selected.Index] -= total
+		return selected, nil
 	}
 
+	if weightless {
+		glog.V(5).Infof("No instance of %s has a non-zero weight", cl.Name)
+		return nil, ErrNoWeight
+	}
+
+	// The last instance checked
+	instance := unavailable
 	lastStatus := instance.Status
 
 	if lastStatus == nil && !instance.Location.IsFullyDefined() {
@@ -63,7 +101,11 @@ func (cl *ServiceCluster) Next() (*Service, error) {
 	return nil, StatusError{instance.Status.Compute(), lastStatus}
 }
 
-func (cl *ServiceCluster) Remove(instanceIndex string) {
+// Remove an instance by its key (index). Returns the removed instance, nil
+// if not found.
+func (cl *ServiceCluster) Remove(instanceIndex string) *Service {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
 
 	match := -1
 	for k, v := range cl.Instances {
@@ -72,12 +114,21 @@ func (cl *ServiceCluster) Remove(instanceIndex string) {
 		}
 	}
 
+	if match == -1 {
+		return nil
+	}
+
+	removed := cl.Instances[match]
 	cl.Instances = append(cl.Instances[:match], cl.Instances[match+1:]...)
-	cl.Dump("remove")
+	delete(cl.currentWeights, instanceIndex)
+	cl.dump("remove")
+	return removed
 }
 
 // Get an service by its key (index). Returns nil if not found.
 func (cl *ServiceCluster) Get(instanceIndex string) *Service {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
 	for i, v := range cl.Instances {
 		if v.Index == instanceIndex {
 			return cl.Instances[i]
@@ -87,6 +138,8 @@ func (cl *ServiceCluster) Get(instanceIndex string) *Service {
 }
 
 func (cl *ServiceCluster) Add(service *Service) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
 
 	for index, v := range cl.Instances {
 		if v.Index == service.Index {
@@ -99,11 +152,22 @@ func (cl *ServiceCluster) Add(service *Service) {
 }
 
 func (cl *ServiceCluster) Dump(action string) {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	cl.dump(action)
+}
+
+func (cl *ServiceCluster) dump(action string) {
 	for _, v := range cl.Instances {
 		glog.Infof("Dump after %s %s -> %s:%d", action, v.Index, v.Location.Host, v.Location.Port)
 	}
 }
 
+// GetInstances returns a copy of the instances of the cluster.
 func (cl *ServiceCluster) GetInstances() []*Service {
-	return cl.Instances
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	instances := make([]*Service, len(cl.Instances))
+	copy(instances, cl.Instances)
+	return instances
 }
@@ -89,6 +89,52 @@ func Test_cluster(t *testing.T) {
 
 		})
 
+		Convey("When the cluster contains services of different weights", func() {
+			cluster.Add(withWeight(getService("1", "nxio-0001", true), 3))
+			cluster.Add(withWeight(getService("2", "nxio-0001", true), 1))
+			cluster.Add(withWeight(getService("3", "nxio-0001", true), 0))
+
+			Convey("Then it should loadbalance according to the weights", func() {
+				var indexes []string
+				for i := 0; i < 8; i++ {
+					service, err := cluster.Next()
+					So(err, ShouldBeNil)
+					indexes = append(indexes, service.Index)
+				}
+				So(indexes, ShouldResemble, []string{"1", "1", "2", "1", "1", "1", "2", "1"})
+			})
+
+			Convey("Then it should never loadbalance on a service of weight 0", func() {
+				cluster.Remove("1")
+				cluster.Remove("2")
+				service, err := cluster.Next()
+				So(service, ShouldBeNil)
+				So(err, ShouldNotBeNil)
+				So(len(cluster.Instances), ShouldEqual, 1)
+			})
+
+			Convey("Then it reports that all the started services have a weight of 0", func() {
+				withWeight(cluster.Get("1"), 0)
+				withWeight(cluster.Get("2"), 0)
+				service, err := cluster.Next()
+				So(service, ShouldBeNil)
+				So(err, ShouldEqual, ErrNoWeight)
+			})
+
+			Convey("Then a weight of 0 is reported before the status of an inactive service", func() {
+				cluster.Remove("1")
+				cluster.Add(getService("4", "nxio-0001", false))
+				withWeight(cluster.Get("2"), 0)
+				_, err := cluster.Next()
+				So(err, ShouldEqual, ErrNoWeight)
+
+				cluster.Remove("2")
+				cluster.Remove("3")
+				_, err = cluster.Next()
+				So(err, ShouldHaveSameTypeAs, StatusError{})
+			})
+		})
+
 		Convey("When removing a key to a cluster", func() {
 			cluster.Add(getService("1", "nxio-0001", true))
 			cluster.Add(getService("2", "nxio-0001", false))
@@ -102,6 +148,11 @@ func Test_cluster(t *testing.T) {
 				So(len(cluster.Instances), ShouldEqual, initSize-1)
 
 			})
+
+			Convey("Then removing an unknown key does nothing", func() {
+				So(cluster.Remove("4"), ShouldBeNil)
+				So(len(cluster.Instances), ShouldEqual, initSize-1)
+			})
 		})
 
 	})
@@ -162,6 +213,29 @@ func Test_Service(t *testing.T) {
 			})
 
 		})
+		Convey("When weight is not the same", func() {
+			withWeight(service2, 2)
+			Convey("Then they are not equal", func() {
+
+				So(service1.Equals(service2), ShouldEqual, false)
+
+			})
+
+			Convey("Then it is read from the config node", func() {
+				service, _ := NewService(&Node{
+					Key: "/services/nxio-0001/1",
+					Nodes: []*Node{
+						{Key: "/services/nxio-0001/1/config", Nodes: []*Node{
+							{Key: "/services/nxio-0001/1/config/gogeta", Value: `{"robots":"","weight":2}`},
+						}},
+					},
+				})
+				So(service.Config.GetWeight(), ShouldEqual, 2)
+				So(service.Config.Equals(service2.Config), ShouldBeTrue)
+			})
+
+		})
+
 		Convey("When alive status is not the same", func() {
 			service2.Status.Alive = "other"
 			Convey("Then they are not equal", func() {
@@ -192,3 +266,8 @@ func getService(index string, name string, active bool) *Service {
 	}
 
 }
+
+func withWeight(service *Service, weight int) *Service {
+	service.Config = &ServiceConfig{Weight: &weight}
+	return service
+}
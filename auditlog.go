@@ -0,0 +1,195 @@
+package goarken
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// An AuditLog persists the status changes seen by a Watcher.
+type AuditLog interface {
+	Append(change *StatusChange) error
+	// Query returns the logged changes matching query, oldest first.
+	Query(query AuditQuery) ([]*StatusChange, error)
+}
+
+// An AuditQuery selects status changes. Zero fields select everything.
+type AuditQuery struct {
+	Service  string
+	Instance string
+	// Changes at or after Since and before Until
+	Since time.Time
+	Until time.Time
+	// Only the last Limit changes
+	Limit int
+}
+
+func (q *AuditQuery) matches(change *StatusChange) bool {
+	return (q.Service == "" || change.Service == q.Service) &&
+		(q.Instance == "" || change.Instance == q.Instance) &&
+		(q.Since.IsZero() || !change.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || change.Time.Before(q.Until))
+}
+
+// Filters changes with query.
+func (q *AuditQuery) apply(changes []*StatusChange) []*StatusChange {
+	var matching []*StatusChange
+	for _, change := range changes {
+		if q.matches(change) {
+			matching = append(matching, change)
+		}
+	}
+	if q.Limit > 0 && len(matching) > q.Limit {
+		matching = matching[len(matching)-q.Limit:]
+	}
+	return matching
+}
+
+// Number of changes a FileAuditLog queues before Append waits for the file.
+const auditLogQueueSize = 1000
+
+// A FileAuditLog appends the status changes to a file, as JSON lines. The
+// writes are done by a goroutine, so that the Watcher does not wait for the
+// file while it broadcasts: Append only queues the change, unless the queue
+// is full.
+type FileAuditLog struct {
+	path string
+	file *os.File
+	// Held while the file is written or read
+	lock  sync.Mutex
+	queue chan *auditEntry
+	// Held while queueing, so that the queue is not closed meanwhile
+	queueLock sync.RWMutex
+	closed    bool
+	done      chan struct{}
+}
+
+// A queued change, or a flush request closed once the changes queued before
+// it are written.
+type auditEntry struct {
+	change  *StatusChange
+	flushed chan struct{}
+}
+
+// OpenFileAuditLog opens the audit log stored at path, created if needed.
+func OpenFileAuditLog(path string) (*FileAuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &FileAuditLog{
+		path:  path,
+		file:  file,
+		queue: make(chan *auditEntry, auditLogQueueSize),
+		done:  make(chan struct{}),
+	}
+	go l.write()
+	return l, nil
+}
+
+// Append queues the change. Write errors are logged, since the change is
+// written later.
+func (l *FileAuditLog) Append(change *StatusChange) error {
+	return l.enqueue(&auditEntry{change: change})
+}
+
+// Query reads the whole file, once the changes appended before are written.
+func (l *FileAuditLog) Query(query AuditQuery) ([]*StatusChange, error) {
+	flushed := make(chan struct{})
+	if err := l.enqueue(&auditEntry{flushed: flushed}); err == nil {
+		<-flushed
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	changes, err := ReadStatusChanges(file)
+	if err != nil {
+		return nil, err
+	}
+	return query.apply(changes), nil
+}
+
+// Close writes the queued changes and closes the file.
+func (l *FileAuditLog) Close() error {
+	l.queueLock.Lock()
+	if l.closed {
+		l.queueLock.Unlock()
+		return errors.New("Audit log already closed")
+	}
+	l.closed = true
+	close(l.queue)
+	l.queueLock.Unlock()
+
+	<-l.done
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+func (l *FileAuditLog) enqueue(entry *auditEntry) error {
+	l.queueLock.RLock()
+	defer l.queueLock.RUnlock()
+	if l.closed {
+		return errors.New("Audit log closed")
+	}
+	l.queue <- entry
+	return nil
+}
+
+// Writes the queued changes until the queue is closed.
+func (l *FileAuditLog) write() {
+	defer close(l.done)
+	for entry := range l.queue {
+		if entry.flushed != nil {
+			close(entry.flushed)
+			continue
+		}
+		l.lock.Lock()
+		err := WriteStatusChanges(l.file, []*StatusChange{entry.change})
+		l.lock.Unlock()
+		if err != nil {
+			glog.Errorf("Unable to log the status change of %s/%s: %v", entry.change.Service, entry.change.Instance, err)
+		}
+	}
+}
+
+// WriteStatusChanges writes changes as JSON lines.
+func WriteStatusChanges(writer io.Writer, changes []*StatusChange) error {
+	encoder := json.NewEncoder(writer)
+	for _, change := range changes {
+		if err := encoder.Encode(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadStatusChanges reads the JSON lines written by WriteStatusChanges.
+func ReadStatusChanges(reader io.Reader) ([]*StatusChange, error) {
+	var changes []*StatusChange
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		change := &StatusChange{}
+		if err := json.Unmarshal(scanner.Bytes(), change); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, scanner.Err()
+}
@@ -0,0 +1,217 @@
+package goarken
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrKeyNotFound is returned by a Backend when the requested key does not
+	// exist.
+	ErrKeyNotFound = errors.New("Key not found")
+
+	// ErrWatchStopped is returned by Backend.Watch when it has been stopped
+	// through its stop channel.
+	ErrWatchStopped = errors.New("Watch stopped")
+
+	// ErrIndexCleared is returned by Backend.Watch when the changes from the
+	// requested index are not available anymore. The state has to be loaded
+	// again before watching from the current index.
+	ErrIndexCleared = errors.New("The event in requested index is outdated and cleared")
+
+	// ErrKeyExists is returned by Backend.Create when the key already exists.
+	ErrKeyExists = errors.New("Key already exists")
+
+	// ErrCompareFailed is returned by Backend.CompareAndSwap when the key has
+	// been modified by someone else.
+	ErrCompareFailed = errors.New("Compare failed")
+)
+
+// A Backend is a hierarchical key-value store holding the Arken model. Keys
+// are slash separated paths organized in directories, the same way etcd v2
+// does it.
+type Backend interface {
+	// Get returns the node stored at key. When recursive is true, the whole
+	// sub-tree of a directory is returned, sorted by key.
+	Get(key string, recursive bool) (*Response, error)
+
+	// Set stores value at key, creating the intermediate directories. A non
+	// zero ttl makes the key expire after ttl seconds.
+	Set(key string, value string, ttl uint64) (*Response, error)
+
+	// Create stores value at key like Set, only if key does not exist yet.
+	// ErrKeyExists is returned otherwise.
+	Create(key string, value string, ttl uint64) (*Response, error)
+
+	// CompareAndSwap stores value at key like Set, only if its current value
+	// is prevValue and its modified index is prevIndex. An empty prevValue or
+	// a zero prevIndex is not compared. ErrCompareFailed is returned when the
+	// comparison fails, ErrKeyNotFound when key does not exist.
+	CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error)
+
+	// Delete removes key, and all its children when recursive is true.
+	Delete(key string, recursive bool) (*Response, error)
+
+	// Watch sends every change made under prefix to receiver, starting at
+	// waitIndex (0 meaning from now on). It blocks until stop is closed or
+	// an error occurs, and closes receiver before returning.
+	Watch(prefix string, waitIndex uint64, receiver chan *Response, stop chan bool) error
+}
+
+// A TxnBackend is a Backend able to write several keys atomically.
+type TxnBackend interface {
+	Backend
+
+	// Txn sets the keys of ops at the same index, only if the conditions of
+	// all of them hold. Nothing is written otherwise, and the error of the
+	// first failing condition is returned (ErrKeyExists, ErrKeyNotFound or
+	// ErrCompareFailed). It returns the index of the writes.
+	Txn(ops []*TxnOp) (uint64, error)
+}
+
+// A TxnOp sets Key to Value in a transaction, without TTL. When Create is
+// true, the key must not exist. Otherwise PrevValue and PrevIndex are
+// compared like in CompareAndSwap, and the key is set whether it exists or
+// not when both are empty. With CheckOnly, the condition is checked but the
+// key is not written.
+type TxnOp struct {
+	Key       string
+	Value     string
+	Create    bool
+	PrevValue string
+	PrevIndex uint64
+	CheckOnly bool
+}
+
+// Check returns the error of the condition of op on node, the current node
+// of its key (nil if it does not exist).
+func (op *TxnOp) Check(node *Node) error {
+	switch {
+	case op.Create && node != nil:
+		return ErrKeyExists
+	case op.Create || (op.PrevValue == "" && op.PrevIndex == 0):
+		return nil
+	case node == nil:
+		return ErrKeyNotFound
+	case (op.PrevValue != "" && node.Value != op.PrevValue) || (op.PrevIndex != 0 && node.ModifiedIndex != op.PrevIndex):
+		return ErrCompareFailed
+	}
+	return nil
+}
+
+// Action of the change made by op, as reported by the other writes.
+func (op *TxnOp) Action() string {
+	switch {
+	case op.Create:
+		return "create"
+	case op.PrevValue != "" || op.PrevIndex != 0:
+		return "compareAndSwap"
+	}
+	return "set"
+}
+
+// A Node is a key of a Backend. Directories hold their children in Nodes.
+type Node struct {
+	Key           string
+	Value         string
+	Dir           bool
+	Expiration    *time.Time
+	TTL           int64
+	Nodes         Nodes
+	ModifiedIndex uint64
+	CreatedIndex  uint64
+}
+
+type Nodes []*Node
+
+// Nodes sort by key
+func (ns Nodes) Len() int {
+	return len(ns)
+}
+
+func (ns Nodes) Less(i, j int) bool {
+	return ns[i].Key < ns[j].Key
+}
+
+func (ns Nodes) Swap(i, j int) {
+	ns[i], ns[j] = ns[j], ns[i]
+}
+
+// A Response is the result of an operation on a Backend, or a change
+// notified by a Watch. Action is one of get, set, create, update, delete,
+// expire or compareAndSwap.
+type Response struct {
+	Action   string
+	Node     *Node
+	PrevNode *Node
+	// Index of the backend when the response was produced.
+	Index uint64
+}
+
+// BuildTree rebuilds the directory rooted at key from the flat list of leaves
+// it contains, for backends that don't have directories. When recursive is
+// false, sub directories are returned without their children. It returns nil
+// when there is no leaf under key.
+func BuildTree(key string, leaves []*Node, recursive bool) *Node {
+	base := strings.TrimSuffix(key, "/") + "/"
+	root := &Node{Key: key, Dir: true}
+	dirs := map[string]*Node{key: root}
+
+	for _, leaf := range leaves {
+		if !strings.HasPrefix(leaf.Key, base) {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(leaf.Key, base), "/")
+		if !recursive && len(parts) > 2 {
+			parts = parts[:2]
+		}
+
+		parent := root
+		for i := range parts[:len(parts)-1] {
+			dirKey := base + strings.Join(parts[:i+1], "/")
+			dir := dirs[dirKey]
+			if dir == nil {
+				dir = &Node{Key: dirKey, Dir: true, CreatedIndex: leaf.CreatedIndex}
+				dirs[dirKey] = dir
+				parent.Nodes = append(parent.Nodes, dir)
+			}
+			dir.updateIndexes(leaf)
+			parent = dir
+			if !recursive {
+				// Sub directory content is not returned
+				parent = nil
+				break
+			}
+		}
+		root.updateIndexes(leaf)
+
+		if parent != nil {
+			parent.Nodes = append(parent.Nodes, leaf)
+		}
+	}
+
+	if len(root.Nodes) == 0 {
+		return nil
+	}
+	root.sortNodes()
+	return root
+}
+
+// Keeps the indexes of a directory in sync with the ones of its leaves.
+func (n *Node) updateIndexes(leaf *Node) {
+	if leaf.ModifiedIndex > n.ModifiedIndex {
+		n.ModifiedIndex = leaf.ModifiedIndex
+	}
+	if n.CreatedIndex == 0 || leaf.CreatedIndex < n.CreatedIndex {
+		n.CreatedIndex = leaf.CreatedIndex
+	}
+}
+
+func (n *Node) sortNodes() {
+	sort.Sort(n.Nodes)
+	for _, child := range n.Nodes {
+		child.sortNodes()
+	}
+}
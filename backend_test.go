@@ -0,0 +1,57 @@
+package goarken
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func Test_BuildTree(t *testing.T) {
+	var leaves []*Node
+
+	Convey("Given flat keys of a service", t, func() {
+		leaves = []*Node{
+			{Key: "/services/my_service/1/domain", Value: "mydomain.com", ModifiedIndex: 3, CreatedIndex: 3},
+			{Key: "/services/my_service/1/status/current", Value: "started", ModifiedIndex: 5, CreatedIndex: 4},
+			{Key: "/services/my_service/1/location", Value: "{}", ModifiedIndex: 2, CreatedIndex: 2},
+		}
+
+		Convey("When the tree is built recursively", func() {
+			node := BuildTree("/services/my_service", leaves, true)
+
+			Convey("Then it contains directories", func() {
+				So(node.Dir, ShouldBeTrue)
+				So(len(node.Nodes), ShouldEqual, 1)
+
+				index := node.Nodes[0]
+				So(index.Key, ShouldEqual, "/services/my_service/1")
+				So(index.Dir, ShouldBeTrue)
+				So(index.ModifiedIndex, ShouldEqual, 5)
+				So(index.CreatedIndex, ShouldEqual, 2)
+
+				So(len(index.Nodes), ShouldEqual, 3)
+				So(index.Nodes[0].Key, ShouldEqual, "/services/my_service/1/domain")
+				So(index.Nodes[1].Key, ShouldEqual, "/services/my_service/1/location")
+				So(index.Nodes[2].Key, ShouldEqual, "/services/my_service/1/status")
+				So(index.Nodes[2].Nodes[0].Value, ShouldEqual, "started")
+			})
+		})
+
+		Convey("When the tree is not built recursively", func() {
+			node := BuildTree("/services/my_service/1", leaves, false)
+
+			Convey("Then sub directories are empty", func() {
+				So(len(node.Nodes), ShouldEqual, 3)
+				So(node.Nodes[2].Dir, ShouldBeTrue)
+				So(node.Nodes[2].Nodes, ShouldBeNil)
+			})
+		})
+
+		Convey("When no key is under the requested one", func() {
+			node := BuildTree("/domains", leaves, true)
+
+			Convey("Then there is no tree", func() {
+				So(node, ShouldBeNil)
+			})
+		})
+	})
+}
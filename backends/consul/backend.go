@@ -0,0 +1,575 @@
+// Package consul stores the Arken model in the Consul KV store.
+//
+// Keys keep the etcd layout (services/my_service/1/location...), directories
+// are the keys sharing their prefix and modified indexes are Consul modify
+// indexes. A key with a TTL is held by a Consul session with the delete
+// behavior, so that it is removed when the session is not renewed anymore.
+// Watches are implemented with blocking queries.
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/arkenio/goarken"
+	"github.com/golang/glog"
+	"github.com/hashicorp/consul/api"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Consul doesn't accept session TTLs under 10 seconds
+	MinSessionTTL = 10 * time.Second
+
+	DefaultWaitTime = 5 * time.Minute
+)
+
+type Backend struct {
+	Client *api.Client
+	// Prefix of every key in Consul, like "arken/". Empty by default.
+	Prefix string
+	// Maximum duration of a blocking query.
+	WaitTime time.Duration
+}
+
+func NewBackend(client *api.Client) *Backend {
+	return &Backend{
+		Client:   client,
+		WaitTime: DefaultWaitTime,
+	}
+}
+
+func (b *Backend) Get(key string, recursive bool) (*goarken.Response, error) {
+	consulKey := b.consulKey(key)
+	if !isRoot(key) {
+		pair, meta, err := b.Client.KV().Get(consulKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		if pair != nil {
+			return &goarken.Response{
+				Action: "get",
+				Node:   b.toNode(pair),
+				Index:  meta.LastIndex,
+			}, nil
+		}
+	}
+
+	pairs, meta, err := b.Client.KV().List(dirPrefix(consulKey), nil)
+	if err != nil {
+		return nil, err
+	}
+	node := goarken.BuildTree(key, b.toNodes(pairs), recursive)
+	if node == nil && isRoot(key) {
+		// The root always exists, like in etcd
+		node = &goarken.Node{Key: "/", Dir: true}
+	}
+	if node == nil {
+		return nil, goarken.ErrKeyNotFound
+	}
+
+	return &goarken.Response{
+		Action: "get",
+		Node:   node,
+		Index:  meta.LastIndex,
+	}, nil
+}
+
+// Set stores value at key. A non zero ttl makes the key held by a session of
+// ttl seconds (at least MinSessionTTL), setting it again renews the session.
+func (b *Backend) Set(key string, value string, ttl uint64) (*goarken.Response, error) {
+	kv := b.Client.KV()
+	consulKey := b.consulKey(key)
+
+	if b.isDir(consulKey) {
+		return nil, fmt.Errorf("Not a file: %s", key)
+	}
+
+	prev, _, err := kv.Get(consulKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pair := &api.KVPair{Key: consulKey, Value: []byte(value)}
+	if prev != nil && prev.Session != "" {
+		if ttl > 0 && b.renew(prev.Session) {
+			pair.Session = prev.Session
+		} else {
+			b.release(prev)
+		}
+	}
+
+	if ttl > 0 {
+		if pair.Session == "" {
+			pair.Session, err = b.createSession(key, ttl)
+			if err != nil {
+				return nil, err
+			}
+		}
+		acquired, _, err := kv.Acquire(pair, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !acquired {
+			return nil, fmt.Errorf("Unable to acquire %s with session %s", key, pair.Session)
+		}
+	} else if _, err := kv.Put(pair, nil); err != nil {
+		return nil, err
+	}
+
+	return b.putResponse("set", consulKey, ttl, prev)
+}
+
+// Create stores value at key in a transaction checking that it does not
+// exist.
+func (b *Backend) Create(key string, value string, ttl uint64) (*goarken.Response, error) {
+	consulKey := b.consulKey(key)
+	if b.isDir(consulKey) {
+		return nil, goarken.ErrKeyExists
+	}
+
+	check := &api.KVTxnOp{Verb: api.KVCheckNotExists, Key: consulKey}
+	if err := b.putChecked(key, check, nil, value, ttl); err != nil {
+		if err == errCheckFailed {
+			return nil, goarken.ErrKeyExists
+		}
+		return nil, err
+	}
+	return b.putResponse("create", consulKey, ttl, nil)
+}
+
+// CompareAndSwap stores value at key in a transaction checking its modify
+// index. As Consul can't compare values, prevValue is compared with the value
+// read before.
+func (b *Backend) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*goarken.Response, error) {
+	consulKey := b.consulKey(key)
+	if b.isDir(consulKey) {
+		return nil, fmt.Errorf("Not a file: %s", key)
+	}
+
+	prev, _, err := b.Client.KV().Get(consulKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prev == nil {
+		return nil, goarken.ErrKeyNotFound
+	}
+	if (prevValue != "" && string(prev.Value) != prevValue) || (prevIndex != 0 && prev.ModifyIndex != prevIndex) {
+		return nil, goarken.ErrCompareFailed
+	}
+
+	check := &api.KVTxnOp{Verb: api.KVCheckIndex, Key: consulKey, Index: prev.ModifyIndex}
+	if err := b.putChecked(key, check, prev, value, ttl); err != nil {
+		if err == errCheckFailed {
+			return nil, goarken.ErrCompareFailed
+		}
+		return nil, err
+	}
+	return b.putResponse("compareAndSwap", consulKey, ttl, prev)
+}
+
+var errCheckFailed = errors.New("Check failed")
+
+// Puts value at key in a transaction starting with check, which returns
+// errCheckFailed when it fails. The session of prev is renewed, or released
+// and destroyed, like in Set.
+func (b *Backend) putChecked(key string, check *api.KVTxnOp, prev *api.KVPair, value string, ttl uint64) error {
+	var session string
+	var released string
+	if prev != nil && prev.Session != "" {
+		if ttl > 0 && b.renew(prev.Session) {
+			session = prev.Session
+		} else {
+			released = prev.Session
+		}
+	}
+
+	created := false
+	if ttl > 0 && session == "" {
+		var err error
+		if session, err = b.createSession(key, ttl); err != nil {
+			return err
+		}
+		created = true
+	}
+
+	ops := api.KVTxnOps{check}
+	if released != "" {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVUnlock, Key: check.Key, Session: released})
+	}
+	if session != "" {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVLock, Key: check.Key, Value: []byte(value), Session: session})
+	} else {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVSet, Key: check.Key, Value: []byte(value)})
+	}
+
+	ok, txnResponse, _, err := b.Client.KV().Txn(ops, nil)
+	if err == nil && !ok {
+		err = fmt.Errorf("Unable to put %s: %v", key, txnResponse.Errors)
+		for _, txnError := range txnResponse.Errors {
+			if txnError.OpIndex == 0 {
+				err = errCheckFailed
+			}
+		}
+	}
+
+	if err != nil {
+		if created {
+			b.destroy(session)
+		}
+		return err
+	}
+	if released != "" {
+		b.destroy(released)
+	}
+	return nil
+}
+
+// Txn sets all the keys of ops in a single Consul transaction. Their
+// conditions are checked on the pairs read before, and each write is guarded
+// by the index it has been read at. Keys held by a session are released, and
+// their sessions destroyed, like in Set.
+func (b *Backend) Txn(ops []*goarken.TxnOp) (uint64, error) {
+	var txnOps api.KVTxnOps
+	var released []string
+	for _, op := range ops {
+		consulKey := b.consulKey(op.Key)
+		if b.isDir(consulKey) {
+			return 0, fmt.Errorf("Not a file: %s", op.Key)
+		}
+
+		prev, _, err := b.Client.KV().Get(consulKey, nil)
+		if err != nil {
+			return 0, err
+		}
+		var node *goarken.Node
+		if prev != nil {
+			node = b.toNode(prev)
+		}
+		if err := op.Check(node); err != nil {
+			return 0, err
+		}
+
+		if prev == nil {
+			txnOps = append(txnOps, &api.KVTxnOp{Verb: api.KVCheckNotExists, Key: consulKey})
+		} else {
+			txnOps = append(txnOps, &api.KVTxnOp{Verb: api.KVCheckIndex, Key: consulKey, Index: prev.ModifyIndex})
+		}
+		if op.CheckOnly {
+			continue
+		}
+		if prev != nil && prev.Session != "" {
+			txnOps = append(txnOps, &api.KVTxnOp{Verb: api.KVUnlock, Key: consulKey, Value: []byte(op.Value), Session: prev.Session})
+			released = append(released, prev.Session)
+		} else {
+			txnOps = append(txnOps, &api.KVTxnOp{Verb: api.KVSet, Key: consulKey, Value: []byte(op.Value)})
+		}
+	}
+
+	ok, txnResponse, _, err := b.Client.KV().Txn(txnOps, nil)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		for _, txnError := range txnResponse.Errors {
+			if txnOps[txnError.OpIndex].Verb == api.KVCheckNotExists || txnOps[txnError.OpIndex].Verb == api.KVCheckIndex {
+				// Changed since it has been read
+				return 0, goarken.ErrCompareFailed
+			}
+		}
+		return 0, fmt.Errorf("Unable to write the transaction: %v", txnResponse.Errors)
+	}
+
+	for _, session := range released {
+		b.destroy(session)
+	}
+	var index uint64
+	for _, result := range txnResponse.Results {
+		if result.ModifyIndex > index {
+			index = result.ModifyIndex
+		}
+	}
+	return index, nil
+}
+
+// Reads back a key that has been put to get its indexes.
+func (b *Backend) putResponse(action string, consulKey string, ttl uint64, prev *api.KVPair) (*goarken.Response, error) {
+	current, meta, err := b.Client.KV().Get(consulKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, goarken.ErrKeyNotFound
+	}
+
+	response := &goarken.Response{
+		Action: action,
+		Node:   b.toNode(current),
+		Index:  meta.LastIndex,
+	}
+	if ttl > 0 {
+		response.Node.TTL = int64(ttl)
+	}
+	if prev != nil {
+		response.PrevNode = b.toNode(prev)
+	}
+	return response, nil
+}
+
+// Delete removes key, or the keys under it if recursive. The session holding
+// a deleted key is left until its TTL elapses, so that a Watch can tell the
+// deletion from an expiration.
+func (b *Backend) Delete(key string, recursive bool) (*goarken.Response, error) {
+	kv := b.Client.KV()
+	consulKey := b.consulKey(key)
+
+	if isRoot(key) {
+		return nil, errors.New("Root is read only")
+	}
+
+	isDir := b.isDir(consulKey)
+	if isDir && !recursive {
+		return nil, fmt.Errorf("Not a file: %s", key)
+	}
+
+	prev, _, err := kv.Get(consulKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prev == nil && !isDir {
+		return nil, goarken.ErrKeyNotFound
+	}
+
+	ops := api.KVTxnOps{&api.KVTxnOp{Verb: api.KVDelete, Key: consulKey}}
+	if isDir {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVDeleteTree, Key: dirPrefix(consulKey)})
+	}
+	ok, txnResponse, meta, err := kv.Txn(ops, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unable to delete %s: %v", key, txnResponse.Errors)
+	}
+
+	response := &goarken.Response{
+		Action: "delete",
+		Node:   &goarken.Node{Key: key, Dir: isDir, ModifiedIndex: meta.LastIndex},
+		Index:  meta.LastIndex,
+	}
+	if prev != nil {
+		response.PrevNode = b.toNode(prev)
+	}
+	return response, nil
+}
+
+// Watch runs blocking queries on prefix and sends the differences between
+// two successive results. A key that disappears with the session holding it
+// is reported as expired. As Consul keeps no history, ErrIndexCleared is
+// returned when waitIndex is in the past.
+func (b *Backend) Watch(prefix string, waitIndex uint64, receiver chan *goarken.Response, stop chan bool) error {
+	defer close(receiver)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var known map[string]*api.KVPair
+	var index uint64
+	for {
+		options := &api.QueryOptions{WaitIndex: index, WaitTime: b.WaitTime}
+		pairs, meta, err := b.Client.KV().List(b.consulKey(prefix), options.WithContext(ctx))
+		if ctx.Err() != nil {
+			return goarken.ErrWatchStopped
+		}
+		if err != nil {
+			return err
+		}
+
+		current := make(map[string]*api.KVPair)
+		for _, pair := range pairs {
+			if key := b.toKey(pair.Key); inDir(prefix, key) && !strings.HasSuffix(pair.Key, "/") {
+				current[key] = pair
+			}
+		}
+
+		var responses []*goarken.Response
+		if known == nil {
+			if waitIndex > 0 && meta.LastIndex >= waitIndex {
+				// Consul keeps no history: what changed since waitIndex,
+				// deletions included, can't be replayed.
+				return goarken.ErrIndexCleared
+			}
+		} else {
+			responses = b.diff(known, current, meta.LastIndex)
+		}
+
+		for _, response := range responses {
+			select {
+			case receiver <- response:
+			case <-ctx.Done():
+				return goarken.ErrWatchStopped
+			}
+		}
+
+		known = current
+		if meta.LastIndex < index {
+			// The index went backward, start again from scratch
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+	}
+}
+
+// Computes the changes between two results of a blocking query.
+func (b *Backend) diff(known map[string]*api.KVPair, current map[string]*api.KVPair, lastIndex uint64) []*goarken.Response {
+	var responses []*goarken.Response
+
+	for key, pair := range current {
+		prev := known[key]
+		if prev != nil && prev.ModifyIndex == pair.ModifyIndex {
+			continue
+		}
+		response := &goarken.Response{
+			Action: "set",
+			Node:   b.toNode(pair),
+			Index:  pair.ModifyIndex,
+		}
+		if prev != nil {
+			response.PrevNode = b.toNode(prev)
+		}
+		responses = append(responses, response)
+	}
+
+	for key, prev := range known {
+		if current[key] != nil {
+			continue
+		}
+		response := &goarken.Response{
+			Action:   "delete",
+			Node:     &goarken.Node{Key: key, ModifiedIndex: lastIndex, CreatedIndex: prev.CreateIndex},
+			PrevNode: b.toNode(prev),
+			Index:    lastIndex,
+		}
+		if prev.Session != "" && b.expired(prev.Session) {
+			response.Action = "expire"
+		}
+		responses = append(responses, response)
+	}
+
+	sort.Sort(byIndex(responses))
+	return responses
+}
+
+// Returns true if a session does not exist anymore, which is the case once
+// its TTL elapsed. A key deleted after its session expired, but before the
+// deletion is seen, is reported as expired too.
+func (b *Backend) expired(session string) bool {
+	entry, _, err := b.Client.Session().Info(session, nil)
+	if err != nil {
+		glog.Warningf("Unable to read session %s: %v", session, err)
+		return false
+	}
+	return entry == nil
+}
+
+func (b *Backend) createSession(key string, ttl uint64) (string, error) {
+	sessionTTL := time.Duration(ttl) * time.Second
+	if sessionTTL < MinSessionTTL {
+		sessionTTL = MinSessionTTL
+	}
+	id, _, err := b.Client.Session().CreateNoChecks(&api.SessionEntry{
+		Name:     "arken:" + key,
+		Behavior: api.SessionBehaviorDelete,
+		TTL:      sessionTTL.String(),
+		// Allow the key to be held again right after the session is gone
+		LockDelay: time.Millisecond,
+	}, nil)
+	return id, err
+}
+
+// Renews a session, returns false if the session does not exist anymore.
+func (b *Backend) renew(session string) bool {
+	entry, _, err := b.Client.Session().Renew(session, nil)
+	return err == nil && entry != nil
+}
+
+// Releases a key from its session and destroys the session.
+func (b *Backend) release(pair *api.KVPair) {
+	if _, _, err := b.Client.KV().Release(pair, nil); err != nil {
+		glog.Warningf("Unable to release %s from session %s: %v", pair.Key, pair.Session, err)
+	}
+	b.destroy(pair.Session)
+}
+
+func (b *Backend) destroy(session string) {
+	if _, err := b.Client.Session().Destroy(session, nil); err != nil {
+		glog.Warningf("Unable to destroy session %s: %v", session, err)
+	}
+}
+
+// A key is a directory if other keys are stored under it.
+func (b *Backend) isDir(consulKey string) bool {
+	keys, _, err := b.Client.KV().Keys(dirPrefix(consulKey), "/", nil)
+	return err == nil && len(keys) > 0
+}
+
+func (b *Backend) consulKey(key string) string {
+	return strings.TrimPrefix(b.Prefix+strings.TrimPrefix(key, "/"), "/")
+}
+
+func (b *Backend) toKey(consulKey string) string {
+	return "/" + strings.TrimPrefix(consulKey, b.Prefix)
+}
+
+func (b *Backend) toNode(pair *api.KVPair) *goarken.Node {
+	return &goarken.Node{
+		Key:           b.toKey(pair.Key),
+		Value:         string(pair.Value),
+		ModifiedIndex: pair.ModifyIndex,
+		CreatedIndex:  pair.CreateIndex,
+	}
+}
+
+func (b *Backend) toNodes(pairs api.KVPairs) []*goarken.Node {
+	nodes := make([]*goarken.Node, 0, len(pairs))
+	for _, pair := range pairs {
+		if !strings.HasSuffix(pair.Key, "/") {
+			nodes = append(nodes, b.toNode(pair))
+		}
+	}
+	return nodes
+}
+
+func isRoot(key string) bool {
+	return strings.Trim(key, "/") == ""
+}
+
+// Consul prefix of the keys under a directory. The root directory has the
+// prefix of the Backend, possibly empty, which must not be followed by a
+// slash.
+func dirPrefix(consulKey string) string {
+	if consulKey == "" || strings.HasSuffix(consulKey, "/") {
+		return consulKey
+	}
+	return consulKey + "/"
+}
+
+func inDir(dir string, key string) bool {
+	return key == dir || strings.HasPrefix(key, strings.TrimSuffix(dir, "/")+"/")
+}
+
+type byIndex []*goarken.Response
+
+func (r byIndex) Len() int           { return len(r) }
+func (r byIndex) Less(i, j int) bool { return r[i].Index < r[j].Index }
+func (r byIndex) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -0,0 +1,263 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"github.com/arkenio/goarken"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// Watches prefix from waitIndex until stop is closed.
+func watch(backend goarken.Backend, prefix string, waitIndex uint64) (chan *goarken.Response, chan bool, chan error) {
+	receiver := make(chan *goarken.Response, 10)
+	stop := make(chan bool)
+	result := make(chan error, 1)
+	go func() {
+		result <- backend.Watch(prefix, waitIndex, receiver, stop)
+	}()
+	return receiver, stop, result
+}
+
+// Returns the next watched change as "action key value prevValue". Creations
+// and swaps are reported as sets, which is what the Watcher sees of them.
+func next(receiver chan *goarken.Response) string {
+	select {
+	case response := <-receiver:
+		action := response.Action
+		if action == "create" || action == "compareAndSwap" {
+			action = "set"
+		}
+		prevValue := ""
+		if response.PrevNode != nil {
+			prevValue = response.PrevNode.Value
+		}
+		return fmt.Sprintf("%s %s %s %s", action, response.Node.Key, response.Node.Value, prevValue)
+	case <-time.After(5 * time.Second):
+		return "timeout"
+	}
+}
+
+// Changes the keys of an instance and returns the changes watched after each
+// one. ready waits for the watch to be started, and expire makes the session
+// or lease of a key with a TTL expire.
+func watchChanges(backend goarken.Backend, ready func(), expire func(key string)) []string {
+	root, _ := backend.Get("/", false)
+	receiver, stop, _ := watch(backend, "/services", root.Index+1)
+	defer close(stop)
+	ready()
+
+	var changes []string
+	apply := func(response *goarken.Response, err error) {
+		if err != nil {
+			changes = append(changes, err.Error())
+			return
+		}
+		changes = append(changes, next(receiver))
+	}
+
+	apply(backend.Set("/services/my_service/1/location", `{"host":"10.0.0.1"}`, 0))
+	apply(backend.Set("/services/my_service/1/location", `{"host":"10.0.0.2"}`, 0))
+	apply(backend.Create("/services/my_service/1/domain", "mydomain.com", 0))
+	apply(backend.CompareAndSwap("/services/my_service/1/domain", "other.com", 0, "mydomain.com", 0))
+
+	apply(backend.Set("/services/my_service/1/status/alive", "1", 1))
+	apply(backend.Delete("/services/my_service/1/status/alive", false))
+
+	backend.Set("/services/my_service/1/status/alive", "2", 1)
+	changes = append(changes, next(receiver))
+	expire("/services/my_service/1/status/alive")
+	changes = append(changes, next(receiver))
+
+	apply(backend.Delete("/services/my_service/1/location", false))
+	return changes
+}
+
+func Test_Backend(t *testing.T) {
+	var backend *Backend
+	var fake *fakeServer
+
+	Convey("Given a Consul backend", t, func() {
+		backend, fake = startBackend(t)
+
+		Convey("When the keys of an instance are changed", func() {
+			changes := watchChanges(backend, fake.waitQuery, func(key string) {
+				fake.expire(fake.sessionOf(backend.consulKey(key)))
+			})
+
+			Convey("Then the watched changes are the ones of the memory backend", func() {
+				// The memory backend expires keys after their TTL
+				expected := watchChanges(goarken.NewMemoryBackend(), func() {}, func(string) {})
+				So(changes, ShouldResemble, expected)
+				So(changes[5], ShouldStartWith, "delete ")
+				So(changes[7], ShouldStartWith, "expire ")
+			})
+		})
+
+		Convey("When keys are set", func() {
+			backend.Set("/services/my_service/1/location", "{}", 0)
+			backend.Set("/domains/mydomain.com/value", "my_service", 0)
+
+			Convey("Then the root contains them", func() {
+				response, err := backend.Get("/", true)
+				So(err, ShouldBeNil)
+				So(response.Node.Key, ShouldEqual, "/")
+				So(len(response.Node.Nodes), ShouldEqual, 2)
+				So(response.Node.Nodes[0].Key, ShouldEqual, "/domains")
+				So(response.Node.Nodes[1].Nodes[0].Nodes[0].Key, ShouldEqual, "/services/my_service/1")
+			})
+
+			Convey("Then the root of a prefixed backend only contains its keys", func() {
+				prefixed := &Backend{Client: backend.Client, Prefix: "arken/", WaitTime: time.Second}
+				prefixed.Set("/services/other_service/1/location", "{}", 0)
+
+				response, err := prefixed.Get("/", true)
+				So(err, ShouldBeNil)
+				So(len(response.Node.Nodes), ShouldEqual, 1)
+				So(response.Node.Nodes[0].Nodes[0].Key, ShouldEqual, "/services/other_service")
+			})
+
+			Convey("Then an empty root exists", func() {
+				backend.Delete("/services", true)
+				backend.Delete("/domains", true)
+
+				response, err := backend.Get("/", true)
+				So(err, ShouldBeNil)
+				So(response.Node.Dir, ShouldBeTrue)
+				So(response.Node.Nodes, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a key is set with a TTL", func() {
+			response, err := backend.Set("/services/my_service/1/status/alive", "1", 1)
+			So(err, ShouldBeNil)
+			So(response.Node.TTL, ShouldEqual, 1)
+			session := fake.sessionOf("services/my_service/1/status/alive")
+
+			Convey("Then it is held by a session of at least the minimum TTL", func() {
+				So(session, ShouldNotBeEmpty)
+				entry, _, err := backend.Client.Session().Info(session, nil)
+				So(err, ShouldBeNil)
+				So(entry.TTL, ShouldEqual, MinSessionTTL.String())
+				So(entry.Behavior, ShouldEqual, "delete")
+			})
+
+			Convey("Then setting it again with a TTL renews its session", func() {
+				backend.Set("/services/my_service/1/status/alive", "2", 1)
+				So(fake.sessionOf("services/my_service/1/status/alive"), ShouldEqual, session)
+			})
+
+			Convey("Then setting it again without TTL releases it and destroys its session", func() {
+				backend.Set("/services/my_service/1/status/alive", "2", 0)
+				So(fake.sessionOf("services/my_service/1/status/alive"), ShouldBeEmpty)
+
+				entry, _, _ := backend.Client.Session().Info(session, nil)
+				So(entry, ShouldBeNil)
+				response, err := backend.Get("/services/my_service/1/status/alive", false)
+				So(err, ShouldBeNil)
+				So(response.Node.Value, ShouldEqual, "2")
+			})
+
+			Convey("Then it is removed when its session expires", func() {
+				fake.expire(session)
+				_, err := backend.Get("/services/my_service/1/status/alive", false)
+				So(err, ShouldEqual, goarken.ErrKeyNotFound)
+			})
+		})
+
+		Convey("When keys are written in a transaction", func() {
+			backend.Set("/services/my_service/1/status/alive", "1", 1)
+			current, _ := backend.Set("/services/my_service/1/status/current", "stopped", 0)
+			index, err := backend.Txn([]*goarken.TxnOp{
+				{Key: "/services/my_service/1/status/current", Value: "starting", PrevValue: "stopped", PrevIndex: current.Index},
+				{Key: "/services/my_service/1/status/expected", Value: "started", Create: true},
+				{Key: "/services/my_service/1/status/alive", Value: "2"},
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then they are all written at the same index", func() {
+				So(index, ShouldBeGreaterThan, current.Index)
+				response, _ := backend.Get("/services/my_service/1/status", true)
+				So(response.Node.Nodes[0].ModifiedIndex, ShouldEqual, index)
+				So(response.Node.Nodes[1].Value, ShouldEqual, "starting")
+				So(response.Node.Nodes[1].ModifiedIndex, ShouldEqual, index)
+				So(response.Node.Nodes[2].Value, ShouldEqual, "started")
+				So(response.Node.Nodes[2].ModifiedIndex, ShouldEqual, index)
+			})
+
+			Convey("Then the keys held by a session are released", func() {
+				So(fake.sessionOf("services/my_service/1/status/alive"), ShouldBeEmpty)
+			})
+
+			Convey("Then none is written when a condition fails", func() {
+				_, err := backend.Txn([]*goarken.TxnOp{
+					{Key: "/services/my_service/1/status/current", Value: "started", PrevValue: "starting"},
+					{Key: "/services/my_service/1/status/expected", Value: "started", Create: true},
+				})
+				So(err, ShouldEqual, goarken.ErrKeyExists)
+
+				_, err = backend.Txn([]*goarken.TxnOp{
+					{Key: "/services/my_service/1/status/current", Value: "started", PrevIndex: current.Index},
+				})
+				So(err, ShouldEqual, goarken.ErrCompareFailed)
+
+				response, _ := backend.Get("/services/my_service/1/status/current", false)
+				So(response.Node.Value, ShouldEqual, "starting")
+			})
+		})
+
+		Convey("When a watch starts from a past index", func() {
+			first, _ := backend.Set("/services/my_service/1/status/current", "starting", 0)
+			backend.Set("/services/my_service/1/status/current", "started", 0)
+
+			receiver, stop, result := watch(backend, "/services", first.Index)
+			defer close(stop)
+
+			Convey("Then the index is cleared", func() {
+				select {
+				case err := <-result:
+					So(err, ShouldEqual, goarken.ErrIndexCleared)
+				case <-time.After(5 * time.Second):
+					So("the watch is not stopped", ShouldBeEmpty)
+				}
+				_, open := <-receiver
+				So(open, ShouldBeFalse)
+			})
+		})
+
+		Convey("When a Watcher misses changes while disconnected", func() {
+			backend.Set("/domains/old.com/type", "service", 0)
+			backend.Set("/domains/old.com/value", "old_service", 0)
+
+			w := &goarken.Watcher{
+				Client:        backend,
+				DomainPrefix:  "/domains",
+				ServicePrefix: "/services",
+				Domains:       make(map[string]*goarken.Domain),
+				Services:      make(map[string]*goarken.ServiceCluster),
+				Backoff:       goarken.Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond},
+			}
+			w.Start(context.Background())
+			defer w.Stop()
+			So(w.WaitForSync(context.Background()), ShouldBeNil)
+			fake.waitQuery()
+
+			fake.fail(true)
+			backend.Delete("/domains/old.com", true)
+			backend.Set("/domains/new.com/type", "service", 0)
+			backend.Set("/domains/new.com/value", "new_service", 0)
+			fake.fail(false)
+
+			Convey("Then it reloads them when it reconnects", func() {
+				deadline := time.Now().Add(5 * time.Second)
+				for w.GetDomain("new.com") == nil && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				So(w.GetDomain("new.com"), ShouldNotBeNil)
+				So(w.GetDomain("new.com").Value, ShouldEqual, "new_service")
+				So(w.GetDomain("old.com"), ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,358 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeServer serves the KV, transaction and session HTTP APIs of Consul
+// from memory, so that the Backend is tested through the real client.
+// Sessions never expire by themselves: expire does what Consul does when
+// the TTL of a session elapses.
+type fakeServer struct {
+	lock     sync.Mutex
+	index    uint64
+	pairs    map[string]*api.KVPair
+	sessions map[string]*api.SessionEntry
+	// Closed and replaced on every change
+	changed chan struct{}
+	// Blocking queries fail while set
+	failing bool
+	// Number of pending blocking queries
+	waiting int
+}
+
+// Starts a fakeServer and returns a Backend connected to it.
+func startBackend(t *testing.T) (*Backend, *fakeServer) {
+	fake := &fakeServer{
+		index:    1,
+		pairs:    make(map[string]*api.KVPair),
+		sessions: make(map[string]*api.SessionEntry),
+		changed:  make(chan struct{}),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewBackend(client), fake
+}
+
+// Expires a session: the keys it holds are deleted.
+func (s *fakeServer) expire(session string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.destroy(session)
+}
+
+// Waits for a blocking query to be pending.
+func (s *fakeServer) waitQuery() {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		s.lock.Lock()
+		waiting := s.waiting
+		s.lock.Unlock()
+		if waiting > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Makes the blocking queries fail, or succeed again.
+func (s *fakeServer) fail(failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing = failing
+	s.notify()
+}
+
+// Returns the session holding key.
+func (s *fakeServer) sessionOf(key string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if pair := s.pairs[key]; pair != nil {
+		return pair.Session
+	}
+	return ""
+}
+
+func (s *fakeServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("X-Consul-KnownLeader", "true")
+	writer.Header().Set("X-Consul-LastContact", "0")
+
+	path := request.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/v1/kv/") && request.Method == http.MethodGet:
+		s.read(writer, request, strings.TrimPrefix(path, "/v1/kv/"))
+	case strings.HasPrefix(path, "/v1/kv/") && request.Method == http.MethodPut:
+		s.write(writer, request, strings.TrimPrefix(path, "/v1/kv/"))
+	case path == "/v1/txn":
+		s.txn(writer, request)
+	case strings.HasPrefix(path, "/v1/session/"):
+		s.session(writer, request, strings.TrimPrefix(path, "/v1/session/"))
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+func (s *fakeServer) read(writer http.ResponseWriter, request *http.Request, key string) {
+	query := request.URL.Query()
+	index, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(query.Get("wait"))
+	if index > 0 && !s.wait(request, index, wait) {
+		http.Error(writer, "Blocking query failed", http.StatusInternalServerError)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	writer.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+
+	var result interface{}
+	found := true
+	switch {
+	case query.Has("keys"):
+		var keys []string
+		for _, pair := range s.under(key) {
+			keys = append(keys, pair.Key)
+		}
+		result, found = keys, len(keys) > 0
+	case query.Has("recurse"):
+		pairs := s.under(key)
+		result, found = pairs, len(pairs) > 0
+	default:
+		result, found = []*api.KVPair{s.pairs[key]}, s.pairs[key] != nil
+	}
+
+	if !found {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(writer).Encode(result)
+}
+
+// Waits until the index is past index. Returns false if the blocking
+// queries fail.
+func (s *fakeServer) wait(request *http.Request, index uint64, wait time.Duration) bool {
+	s.lock.Lock()
+	s.waiting++
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.waiting--
+		s.lock.Unlock()
+	}()
+
+	timeout := time.After(wait)
+	for {
+		s.lock.Lock()
+		changed, current, failing := s.changed, s.index, s.failing
+		s.lock.Unlock()
+
+		switch {
+		case failing:
+			return false
+		case current > index:
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return true
+		case <-request.Context().Done():
+			return false
+		}
+	}
+}
+
+// Pairs under prefix, sorted by key.
+func (s *fakeServer) under(prefix string) []*api.KVPair {
+	var pairs []*api.KVPair
+	for key, pair := range s.pairs {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+func (s *fakeServer) write(writer http.ResponseWriter, request *http.Request, key string) {
+	value, _ := io.ReadAll(request.Body)
+	query := request.URL.Query()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	switch {
+	case query.Has("acquire"):
+		err = s.apply(&api.KVTxnOp{Verb: api.KVLock, Key: key, Value: value, Session: query.Get("acquire")}, s.index+1)
+	case query.Has("release"):
+		err = s.apply(&api.KVTxnOp{Verb: api.KVUnlock, Key: key, Value: value, Session: query.Get("release")}, s.index+1)
+	default:
+		err = s.apply(&api.KVTxnOp{Verb: api.KVSet, Key: key, Value: value}, s.index+1)
+	}
+	if err == nil {
+		s.index++
+		s.notify()
+	}
+	fmt.Fprint(writer, err == nil)
+}
+
+func (s *fakeServer) txn(writer http.ResponseWriter, request *http.Request) {
+	var ops api.TxnOps
+	if err := json.NewDecoder(request.Body).Decode(&ops); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Operations are applied on a copy, kept if they all succeed
+	pairs := s.pairs
+	s.pairs = make(map[string]*api.KVPair, len(pairs))
+	for key, pair := range pairs {
+		copied := *pair
+		s.pairs[key] = &copied
+	}
+
+	response := &api.TxnResponse{}
+	for i, op := range ops {
+		if err := s.apply(op.KV, s.index+1); err != nil {
+			response.Errors = append(response.Errors, &api.TxnError{OpIndex: i, What: err.Error()})
+		} else if pair := s.pairs[op.KV.Key]; pair != nil {
+			copied := *pair
+			response.Results = append(response.Results, &api.TxnResult{KV: &copied})
+		}
+	}
+
+	if len(response.Errors) > 0 {
+		s.pairs = pairs
+		writer.WriteHeader(http.StatusConflict)
+	} else {
+		s.index++
+		s.notify()
+	}
+	json.NewEncoder(writer).Encode(response)
+}
+
+// Applies an operation at index.
+func (s *fakeServer) apply(op *api.KVTxnOp, index uint64) error {
+	pair := s.pairs[op.Key]
+	switch op.Verb {
+	case api.KVCheckNotExists:
+		if pair != nil {
+			return fmt.Errorf("Key %s exists", op.Key)
+		}
+	case api.KVCheckIndex:
+		if pair == nil || pair.ModifyIndex != op.Index {
+			return fmt.Errorf("Index of %s is not %d", op.Key, op.Index)
+		}
+	case api.KVSet:
+		s.put(op.Key, op.Value, index)
+	case api.KVLock:
+		if s.sessions[op.Session] == nil || (pair != nil && pair.Session != "" && pair.Session != op.Session) {
+			return fmt.Errorf("Unable to lock %s", op.Key)
+		}
+		locked := s.put(op.Key, op.Value, index)
+		if locked.Session != op.Session {
+			locked.LockIndex++
+		}
+		locked.Session = op.Session
+	case api.KVUnlock:
+		if pair == nil || pair.Session != op.Session {
+			return fmt.Errorf("Unable to unlock %s", op.Key)
+		}
+		s.put(op.Key, op.Value, index).Session = ""
+	case api.KVDelete:
+		delete(s.pairs, op.Key)
+	case api.KVDeleteTree:
+		for _, pair := range s.under(op.Key) {
+			delete(s.pairs, pair.Key)
+		}
+	default:
+		return fmt.Errorf("Unsupported operation %s", op.Verb)
+	}
+	return nil
+}
+
+// Puts value at key, keeping its session and lock index.
+func (s *fakeServer) put(key string, value []byte, index uint64) *api.KVPair {
+	pair := s.pairs[key]
+	if pair == nil {
+		pair = &api.KVPair{Key: key, CreateIndex: index}
+		s.pairs[key] = pair
+	}
+	pair.Value = value
+	pair.ModifyIndex = index
+	return pair
+}
+
+func (s *fakeServer) session(writer http.ResponseWriter, request *http.Request, path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	writer.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	operation, id, _ := strings.Cut(path, "/")
+	switch operation {
+	case "create":
+		entry := &api.SessionEntry{}
+		json.NewDecoder(request.Body).Decode(entry)
+		s.index++
+		entry.ID = "session-" + strconv.FormatUint(s.index, 10)
+		entry.CreateIndex = s.index
+		s.sessions[entry.ID] = entry
+		json.NewEncoder(writer).Encode(map[string]string{"ID": entry.ID})
+	case "renew":
+		if s.sessions[id] == nil {
+			http.NotFound(writer, request)
+			return
+		}
+		json.NewEncoder(writer).Encode([]*api.SessionEntry{s.sessions[id]})
+	case "destroy":
+		s.destroy(id)
+		fmt.Fprint(writer, true)
+	case "info":
+		entries := []*api.SessionEntry{}
+		if s.sessions[id] != nil {
+			entries = append(entries, s.sessions[id])
+		}
+		json.NewEncoder(writer).Encode(entries)
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+// Destroys a session and deletes the keys it holds.
+func (s *fakeServer) destroy(session string) {
+	if s.sessions[session] == nil {
+		return
+	}
+	delete(s.sessions, session)
+	for key, pair := range s.pairs {
+		if pair.Session == session {
+			delete(s.pairs, key)
+		}
+	}
+	s.index++
+	s.notify()
+}
+
+func (s *fakeServer) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
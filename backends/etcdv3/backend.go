@@ -0,0 +1,455 @@
+// Package etcdv3 stores the Arken model in etcd through the v3 API.
+//
+// The v2 hierarchy is kept as is: every leaf of the tree is a v3 key
+// (/services/my_service/1/location...) and directories are the key ranges
+// sharing their prefix. Modified indexes are v3 revisions, and TTLs are
+// implemented with leases.
+package etcdv3
+
+import (
+	"context"
+	"fmt"
+	"github.com/arkenio/goarken"
+	"github.com/golang/glog"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+)
+
+type Backend struct {
+	Client *clientv3.Client
+	// Timeout of every request but watches.
+	Timeout time.Duration
+}
+
+func NewBackend(client *clientv3.Client) *Backend {
+	return &Backend{
+		Client:  client,
+		Timeout: DefaultTimeout,
+	}
+}
+
+// Get reads a key, or builds the tree of a directory from the keys under it.
+// The root always exists. Without recursion, only its revision is read, not
+// the whole keyspace: its children are not returned.
+func (b *Backend) Get(key string, recursive bool) (*goarken.Response, error) {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	if key == "/" && !recursive {
+		response, err := b.Client.Get(ctx, "/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return nil, err
+		}
+		revision := uint64(response.Header.Revision)
+		return &goarken.Response{
+			Action: "get",
+			Node:   &goarken.Node{Key: "/", Dir: true, ModifiedIndex: revision},
+			Index:  revision,
+		}, nil
+	}
+
+	response, err := b.Client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Kvs) > 0 {
+		return &goarken.Response{
+			Action: "get",
+			Node:   toNode(response.Kvs[0]),
+			Index:  uint64(response.Header.Revision),
+		}, nil
+	}
+
+	response, err = b.Client.Get(ctx, dirPrefix(key), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := make([]*goarken.Node, 0, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		leaves = append(leaves, toNode(kv))
+	}
+	node := goarken.BuildTree(key, leaves, recursive)
+	if node == nil && key == "/" {
+		node = &goarken.Node{Key: "/", Dir: true}
+	}
+	if node == nil {
+		return nil, goarken.ErrKeyNotFound
+	}
+
+	return &goarken.Response{
+		Action: "get",
+		Node:   node,
+		Index:  uint64(response.Header.Revision),
+	}, nil
+}
+
+// Set stores value at key. A non zero ttl attaches the key to a new lease
+// of ttl seconds, the lease previously attached to the key is revoked.
+func (b *Backend) Set(key string, value string, ttl uint64) (*goarken.Response, error) {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	if b.isDir(ctx, key) {
+		return nil, fmt.Errorf("Not a file: %s", key)
+	}
+
+	options, _, err := b.putOptions(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := b.Client.Put(ctx, key, value, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.putResponse(ctx, "set", key, value, ttl, response.Header.Revision, response.PrevKv), nil
+}
+
+// Create puts key in a transaction checking that it has never been created,
+// or has been deleted since.
+func (b *Backend) Create(key string, value string, ttl uint64) (*goarken.Response, error) {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	if b.isDir(ctx, key) {
+		return nil, goarken.ErrKeyExists
+	}
+
+	options, lease, err := b.putOptions(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := b.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, options...)).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !response.Succeeded {
+		b.revokeUnused(ctx, key, lease)
+		return nil, goarken.ErrKeyExists
+	}
+
+	return b.putResponse(ctx, "create", key, value, ttl, response.Header.Revision, nil), nil
+}
+
+// CompareAndSwap puts key in a transaction comparing its value and its
+// modification revision.
+func (b *Backend) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*goarken.Response, error) {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	comparisons := []clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(key), ">", 0)}
+	if prevValue != "" {
+		comparisons = append(comparisons, clientv3.Compare(clientv3.Value(key), "=", prevValue))
+	}
+	if prevIndex != 0 {
+		comparisons = append(comparisons, clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex)))
+	}
+
+	options, lease, err := b.putOptions(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := b.Client.Txn(ctx).
+		If(comparisons...).
+		Then(clientv3.OpPut(key, value, options...)).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !response.Succeeded {
+		b.revokeUnused(ctx, key, lease)
+		if response.Responses[0].GetResponseRange().Count == 0 {
+			return nil, goarken.ErrKeyNotFound
+		}
+		return nil, goarken.ErrCompareFailed
+	}
+
+	prevKv := response.Responses[0].GetResponsePut().PrevKv
+	return b.putResponse(ctx, "compareAndSwap", key, value, ttl, response.Header.Revision, prevKv), nil
+}
+
+// Options of a put, with a new lease of ttl seconds if ttl is not zero.
+func (b *Backend) putOptions(ctx context.Context, ttl uint64) ([]clientv3.OpOption, clientv3.LeaseID, error) {
+	options := []clientv3.OpOption{clientv3.WithPrevKV()}
+	if ttl == 0 {
+		return options, clientv3.NoLease, nil
+	}
+	lease, err := b.Client.Grant(ctx, int64(ttl))
+	if err != nil {
+		return nil, clientv3.NoLease, err
+	}
+	return append(options, clientv3.WithLease(lease.ID)), lease.ID, nil
+}
+
+// Revokes the lease of a put that has not been done.
+func (b *Backend) revokeUnused(ctx context.Context, key string, lease clientv3.LeaseID) {
+	if lease == clientv3.NoLease {
+		return
+	}
+	if _, err := b.Client.Revoke(ctx, lease); err != nil {
+		glog.Warningf("Unable to revoke lease %x of %s: %v", lease, key, err)
+	}
+}
+
+// Builds the response of a put, and revokes the lease previously attached to
+// the key.
+func (b *Backend) putResponse(ctx context.Context, action string, key string, value string, ttl uint64, revision int64, prevKv *mvccpb.KeyValue) *goarken.Response {
+	result := &goarken.Response{
+		Action: action,
+		Node: &goarken.Node{
+			Key:           key,
+			Value:         value,
+			TTL:           int64(ttl),
+			ModifiedIndex: uint64(revision),
+			CreatedIndex:  uint64(revision),
+		},
+		Index: uint64(revision),
+	}
+
+	if prevKv != nil {
+		result.PrevNode = toNode(prevKv)
+		result.Node.CreatedIndex = uint64(prevKv.CreateRevision)
+		b.revokeReplaced(ctx, prevKv)
+	}
+
+	return result
+}
+
+// Revokes the lease of a key that has been put again: it is not attached to
+// any key anymore.
+func (b *Backend) revokeReplaced(ctx context.Context, prevKv *mvccpb.KeyValue) {
+	if prevKv == nil || prevKv.Lease == 0 {
+		return
+	}
+	if _, err := b.Client.Revoke(ctx, clientv3.LeaseID(prevKv.Lease)); err != nil {
+		glog.Warningf("Unable to revoke lease %x of %s: %v", prevKv.Lease, prevKv.Key, err)
+	}
+}
+
+// Txn puts all the keys of ops in a single etcd transaction, guarded by the
+// comparisons of their conditions. When it fails, the keys read by the
+// transaction tell which condition failed.
+func (b *Backend) Txn(ops []*goarken.TxnOp) (uint64, error) {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	var comparisons []clientv3.Cmp
+	var puts, gets []clientv3.Op
+	for _, op := range ops {
+		if b.isDir(ctx, op.Key) {
+			return 0, fmt.Errorf("Not a file: %s", op.Key)
+		}
+		switch {
+		case op.Create:
+			comparisons = append(comparisons, clientv3.Compare(clientv3.CreateRevision(op.Key), "=", 0))
+		case op.PrevValue != "" || op.PrevIndex != 0:
+			comparisons = append(comparisons, clientv3.Compare(clientv3.CreateRevision(op.Key), ">", 0))
+			if op.PrevValue != "" {
+				comparisons = append(comparisons, clientv3.Compare(clientv3.Value(op.Key), "=", op.PrevValue))
+			}
+			if op.PrevIndex != 0 {
+				comparisons = append(comparisons, clientv3.Compare(clientv3.ModRevision(op.Key), "=", int64(op.PrevIndex)))
+			}
+		}
+		if !op.CheckOnly {
+			puts = append(puts, clientv3.OpPut(op.Key, op.Value, clientv3.WithPrevKV()))
+		}
+		gets = append(gets, clientv3.OpGet(op.Key))
+	}
+
+	response, err := b.Client.Txn(ctx).If(comparisons...).Then(puts...).Else(gets...).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !response.Succeeded {
+		for i, op := range ops {
+			var node *goarken.Node
+			if kvs := response.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+				node = toNode(kvs[0])
+			}
+			if err := op.Check(node); err != nil {
+				return 0, err
+			}
+		}
+		return 0, goarken.ErrCompareFailed
+	}
+
+	for _, put := range response.Responses {
+		b.revokeReplaced(ctx, put.GetResponsePut().GetPrevKv())
+	}
+	return uint64(response.Header.Revision), nil
+}
+
+func (b *Backend) Delete(key string, recursive bool) (*goarken.Response, error) {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	isDir := b.isDir(ctx, key)
+	if isDir && !recursive {
+		return nil, fmt.Errorf("Not a file: %s", key)
+	}
+
+	ops := []clientv3.Op{clientv3.OpDelete(key, clientv3.WithPrevKV())}
+	if isDir {
+		ops = append(ops, clientv3.OpDelete(dirPrefix(key), clientv3.WithPrefix()))
+	}
+
+	response, err := b.Client.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := response.Responses[0].GetResponseDeleteRange()
+	if deleted.Deleted == 0 && !isDir {
+		return nil, goarken.ErrKeyNotFound
+	}
+
+	revision := uint64(response.Header.Revision)
+	result := &goarken.Response{
+		Action: "delete",
+		Node:   &goarken.Node{Key: key, Dir: isDir, ModifiedIndex: revision},
+		Index:  revision,
+	}
+	if len(deleted.PrevKvs) > 0 {
+		result.PrevNode = toNode(deleted.PrevKvs[0])
+	}
+	return result, nil
+}
+
+// Watch sends the changes under prefix from revision waitIndex. When the
+// underlying watch is interrupted, it is resumed from the revision following
+// the last one received so that no event is lost. Deletion of a key attached
+// to a lease that does not exist anymore is reported as an expiration.
+func (b *Backend) Watch(prefix string, waitIndex uint64, receiver chan *goarken.Response, stop chan bool) error {
+	defer close(receiver)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	revision := int64(waitIndex)
+	for {
+		options := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithCreatedNotify()}
+		if revision > 0 {
+			options = append(options, clientv3.WithRev(revision))
+		}
+
+		for watchResponse := range b.Client.Watch(clientv3.WithRequireLeader(ctx), prefix, options...) {
+			if watchResponse.CompactRevision != 0 {
+				glog.Warningf("Revision %d of %s has been compacted (oldest: %d)", revision, prefix, watchResponse.CompactRevision)
+				return goarken.ErrIndexCleared
+			}
+			if err := watchResponse.Err(); err != nil {
+				return err
+			}
+			if watchResponse.Created && revision == 0 {
+				// Resume after the revision the watch started at
+				revision = watchResponse.Header.Revision + 1
+			}
+
+			for _, event := range watchResponse.Events {
+				revision = event.Kv.ModRevision + 1
+				if !inDir(prefix, string(event.Kv.Key)) {
+					continue
+				}
+				select {
+				case receiver <- b.toResponse(ctx, event):
+				case <-ctx.Done():
+					return goarken.ErrWatchStopped
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			return goarken.ErrWatchStopped
+		}
+		glog.Warningf("Watch of %s interrupted, resuming at revision %d", prefix, revision)
+	}
+}
+
+func (b *Backend) Close() error {
+	return b.Client.Close()
+}
+
+func (b *Backend) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), b.Timeout)
+}
+
+// A key is a directory if other keys are stored under it.
+func (b *Backend) isDir(ctx context.Context, key string) bool {
+	response, err := b.Client.Get(ctx, dirPrefix(key), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	return err == nil && response.Count > 0
+}
+
+func (b *Backend) toResponse(ctx context.Context, event *clientv3.Event) *goarken.Response {
+	response := &goarken.Response{
+		Node:  toNode(event.Kv),
+		Index: uint64(event.Kv.ModRevision),
+	}
+	if event.PrevKv != nil {
+		response.PrevNode = toNode(event.PrevKv)
+	}
+
+	switch event.Type {
+	case mvccpb.PUT:
+		response.Action = "set"
+	case mvccpb.DELETE:
+		response.Action = "delete"
+		if event.PrevKv != nil && event.PrevKv.Lease != 0 && b.expired(ctx, clientv3.LeaseID(event.PrevKv.Lease)) {
+			response.Action = "expire"
+		}
+	}
+	return response
+}
+
+// An expired lease is revoked with its keys, whereas an explicit Delete keeps
+// the lease until its TTL elapses. A lease expiring before its deletion is
+// watched is reported as expired too.
+func (b *Backend) expired(ctx context.Context, lease clientv3.LeaseID) bool {
+	ctx, cancel := context.WithTimeout(ctx, b.Timeout)
+	defer cancel()
+
+	response, err := b.Client.TimeToLive(ctx, lease)
+	if err != nil {
+		glog.Warningf("Unable to read lease %x: %v", lease, err)
+		return false
+	}
+	return response.TTL == -1
+}
+
+func toNode(kv *mvccpb.KeyValue) *goarken.Node {
+	return &goarken.Node{
+		Key:           string(kv.Key),
+		Value:         string(kv.Value),
+		ModifiedIndex: uint64(kv.ModRevision),
+		CreatedIndex:  uint64(kv.CreateRevision),
+	}
+}
+
+func dirPrefix(key string) string {
+	return strings.TrimSuffix(key, "/") + "/"
+}
+
+func inDir(dir string, key string) bool {
+	return key == dir || strings.HasPrefix(key, dirPrefix(dir))
+}
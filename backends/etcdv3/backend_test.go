@@ -0,0 +1,233 @@
+package etcdv3
+
+import (
+	"context"
+	"github.com/arkenio/goarken"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.etcd.io/etcd/client/v3"
+	"testing"
+	"time"
+)
+
+// Watches prefix from waitIndex until stop is closed.
+func watch(backend *Backend, prefix string, waitIndex uint64) (chan *goarken.Response, chan bool, chan error) {
+	receiver := make(chan *goarken.Response, 10)
+	stop := make(chan bool)
+	result := make(chan error, 1)
+	go func() {
+		result <- backend.Watch(prefix, waitIndex, receiver, stop)
+	}()
+	return receiver, stop, result
+}
+
+func next(receiver chan *goarken.Response) *goarken.Response {
+	select {
+	case response := <-receiver:
+		return response
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+}
+
+func Test_Backend(t *testing.T) {
+	backend, _ := startBackend(t)
+	ctx := context.Background()
+
+	Convey("Given an etcd v3 backend", t, func() {
+		backend.Delete("/services", true)
+
+		Convey("When keys of a service are set", func() {
+			backend.Set("/services/my_service/1/location", "{}", 0)
+			response, err := backend.Set("/services/my_service/1/status/current", "started", 0)
+			So(err, ShouldBeNil)
+
+			Convey("Then a key can be read", func() {
+				response, err := backend.Get("/services/my_service/1/status/current", false)
+				So(err, ShouldBeNil)
+				So(response.Node.Value, ShouldEqual, "started")
+				So(response.Node.Dir, ShouldBeFalse)
+			})
+
+			Convey("Then a directory is built from the keys under it", func() {
+				read, err := backend.Get("/services/my_service", true)
+				So(err, ShouldBeNil)
+				So(read.Node.Dir, ShouldBeTrue)
+				So(read.Index, ShouldEqual, response.Index)
+
+				instance := read.Node.Nodes[0]
+				So(instance.Key, ShouldEqual, "/services/my_service/1")
+				So(len(instance.Nodes), ShouldEqual, 2)
+				So(instance.Nodes[1].Key, ShouldEqual, "/services/my_service/1/status")
+				So(instance.Nodes[1].Nodes[0].Value, ShouldEqual, "started")
+			})
+
+			Convey("Then a missing key is not found", func() {
+				_, err := backend.Get("/services/other_service", true)
+				So(err, ShouldEqual, goarken.ErrKeyNotFound)
+			})
+
+			Convey("Then a directory can not be set", func() {
+				_, err := backend.Set("/services/my_service/1", "value", 0)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a key is set with a TTL", func() {
+			response, err := backend.Set("/services/my_service/1/status/alive", "1", 30)
+			So(err, ShouldBeNil)
+			So(response.Node.TTL, ShouldEqual, 30)
+
+			kv, _ := backend.Client.Get(ctx, "/services/my_service/1/status/alive")
+			lease := clientv3.LeaseID(kv.Kvs[0].Lease)
+
+			Convey("Then it is attached to a lease of this TTL", func() {
+				So(lease, ShouldNotEqual, clientv3.NoLease)
+				ttl, err := backend.Client.TimeToLive(ctx, lease)
+				So(err, ShouldBeNil)
+				So(ttl.GrantedTTL, ShouldEqual, 30)
+			})
+
+			Convey("Then setting it again revokes its lease", func() {
+				backend.Set("/services/my_service/1/status/alive", "1", 0)
+				ttl, _ := backend.Client.TimeToLive(ctx, lease)
+				So(ttl.TTL, ShouldEqual, -1)
+
+				kv, _ := backend.Client.Get(ctx, "/services/my_service/1/status/alive")
+				So(kv.Kvs[0].Lease, ShouldEqual, clientv3.NoLease)
+			})
+
+			Convey("Then its deletion is watched as a deletion", func() {
+				receiver, stop, _ := watch(backend, "/services", response.Index+1)
+				defer close(stop)
+
+				backend.Delete("/services/my_service/1/status/alive", false)
+				deleted := next(receiver)
+				So(deleted, ShouldNotBeNil)
+				So(deleted.Action, ShouldEqual, "delete")
+				So(deleted.PrevNode.Value, ShouldEqual, "1")
+			})
+
+			Convey("Then the end of its lease is watched as an expiration", func() {
+				receiver, stop, _ := watch(backend, "/services", response.Index+1)
+				defer close(stop)
+
+				// As when its TTL elapses
+				backend.Client.Revoke(ctx, lease)
+				expired := next(receiver)
+				So(expired, ShouldNotBeNil)
+				So(expired.Action, ShouldEqual, "expire")
+				So(expired.Node.Key, ShouldEqual, "/services/my_service/1/status/alive")
+			})
+		})
+
+		Convey("When keys are written in a transaction", func() {
+			current, _ := backend.Set("/services/my_service/1/status/current", "stopped", 0)
+			index, err := backend.Txn([]*goarken.TxnOp{
+				{Key: "/services/my_service/1/status/current", Value: "starting", PrevValue: "stopped", PrevIndex: current.Index},
+				{Key: "/services/my_service/1/status/expected", Value: "started", Create: true},
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then they are all written at the same revision", func() {
+				So(index, ShouldBeGreaterThan, current.Index)
+				response, _ := backend.Get("/services/my_service/1/status", true)
+				So(response.Node.Nodes[0].Value, ShouldEqual, "starting")
+				So(response.Node.Nodes[0].ModifiedIndex, ShouldEqual, index)
+				So(response.Node.Nodes[1].Value, ShouldEqual, "started")
+				So(response.Node.Nodes[1].ModifiedIndex, ShouldEqual, index)
+			})
+
+			Convey("Then none is written when a condition fails", func() {
+				_, err := backend.Txn([]*goarken.TxnOp{
+					{Key: "/services/my_service/1/status/current", Value: "started", PrevValue: "starting"},
+					{Key: "/services/my_service/1/status/expected", Value: "started", Create: true},
+				})
+				So(err, ShouldEqual, goarken.ErrKeyExists)
+
+				_, err = backend.Txn([]*goarken.TxnOp{
+					{Key: "/services/my_service/1/status/current", Value: "started", PrevIndex: current.Index},
+				})
+				So(err, ShouldEqual, goarken.ErrCompareFailed)
+
+				response, _ := backend.Get("/services/my_service/1/status/current", false)
+				So(response.Node.Value, ShouldEqual, "starting")
+			})
+		})
+
+		Convey("When a watch starts from a past revision", func() {
+			first, _ := backend.Set("/services/my_service/1/status/current", "starting", 0)
+			backend.Set("/services/my_service/1/status/current", "started", 0)
+			backend.Set("/domains/mydomain.com/value", "my_service", 0)
+
+			receiver, stop, result := watch(backend, "/services", first.Index)
+
+			Convey("Then it receives the changes under its prefix from this revision", func() {
+				So(next(receiver).Node.Value, ShouldEqual, "starting")
+				So(next(receiver).Node.Value, ShouldEqual, "started")
+
+				backend.Set("/services/my_service/1/status/current", "stopping", 0)
+				response := next(receiver)
+				So(response.Action, ShouldEqual, "set")
+				So(response.PrevNode.Value, ShouldEqual, "started")
+				So(response.Node.Value, ShouldEqual, "stopping")
+
+				close(stop)
+				So(<-result, ShouldEqual, goarken.ErrWatchStopped)
+			})
+		})
+
+		Convey("When the revision of a watch has been compacted", func() {
+			first, _ := backend.Set("/services/my_service/1/status/current", "starting", 0)
+			last, _ := backend.Set("/services/my_service/1/status/current", "started", 0)
+			_, err := backend.Client.Compact(ctx, int64(last.Index))
+			So(err, ShouldBeNil)
+
+			receiver, stop, result := watch(backend, "/services", first.Index)
+			defer close(stop)
+
+			Convey("Then the index is cleared", func() {
+				select {
+				case err := <-result:
+					So(err, ShouldEqual, goarken.ErrIndexCleared)
+				case <-time.After(5 * time.Second):
+					So("the watch is not stopped", ShouldBeEmpty)
+				}
+				_, open := <-receiver
+				So(open, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func Test_EmptyBackend(t *testing.T) {
+	Convey("Given an etcd v3 backend without any key", t, func() {
+		backend, _ := startBackend(t)
+
+		Convey("Then its root exists", func() {
+			response, err := backend.Get("/", false)
+			So(err, ShouldBeNil)
+			So(response.Node.Dir, ShouldBeTrue)
+			So(response.Index, ShouldBeGreaterThan, 0)
+
+			response, err = backend.Get("/", true)
+			So(err, ShouldBeNil)
+			So(response.Node.Nodes, ShouldBeEmpty)
+		})
+
+		Convey("Then a Watcher syncs with it", func() {
+			w := &goarken.Watcher{
+				Client:        backend,
+				DomainPrefix:  "/domains",
+				ServicePrefix: "/services",
+				Domains:       make(map[string]*goarken.Domain),
+				Services:      make(map[string]*goarken.ServiceCluster),
+			}
+			w.Start(context.Background())
+			defer w.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			So(w.WaitForSync(ctx), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,406 @@
+package etcdv3
+
+import (
+	"bytes"
+	"context"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeServer serves the KV, Watch and Lease APIs of etcd v3 from memory, so
+// that the Backend is tested through the real client. Leases never expire by
+// themselves: revoking one is what etcd does when its TTL elapses.
+type fakeServer struct {
+	pb.UnimplementedKVServer
+	pb.UnimplementedWatchServer
+	pb.UnimplementedLeaseServer
+
+	lock      sync.Mutex
+	revision  int64
+	compacted int64
+	kvs       map[string]*mvccpb.KeyValue
+	// Every change since the compacted revision, with its previous value
+	events []*mvccpb.Event
+	// TTL of the leases by ID
+	leases    map[int64]int64
+	lastLease int64
+	// Closed and replaced on every change
+	changed chan struct{}
+}
+
+// Starts a fakeServer and returns a Backend connected to it.
+func startBackend(t *testing.T) (*Backend, *fakeServer) {
+	fake := &fakeServer{
+		revision: 1,
+		kvs:      make(map[string]*mvccpb.KeyValue),
+		leases:   make(map[int64]int64),
+		changed:  make(chan struct{}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterKVServer(server, fake)
+	pb.RegisterWatchServer(server, fake)
+	pb.RegisterLeaseServer(server, fake)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{listener.Addr().String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return NewBackend(client), fake
+}
+
+func (s *fakeServer) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: s.revision}
+}
+
+// Keys of the range [key, end) sorted, or key alone if end is empty.
+func (s *fakeServer) keys(key []byte, end []byte) []string {
+	var keys []string
+	for k := range s.kvs {
+		if inRange([]byte(k), key, end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func inRange(k []byte, key []byte, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(k, key)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(k, key) >= 0
+	default:
+		return bytes.Compare(k, key) >= 0 && bytes.Compare(k, end) < 0
+	}
+}
+
+func (s *fakeServer) Range(ctx context.Context, request *pb.RangeRequest) (*pb.RangeResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rangeKeys(request), nil
+}
+
+func (s *fakeServer) rangeKeys(request *pb.RangeRequest) *pb.RangeResponse {
+	response := &pb.RangeResponse{Header: s.header()}
+	for _, key := range s.keys(request.Key, request.RangeEnd) {
+		response.Count++
+		if !request.CountOnly {
+			response.Kvs = append(response.Kvs, s.kvs[key])
+		}
+	}
+	return response
+}
+
+func (s *fakeServer) Put(ctx context.Context, request *pb.PutRequest) (*pb.PutResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if request.Lease != 0 && s.leases[request.Lease] == 0 {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	s.revision++
+	response := s.put(request)
+	s.notify()
+	return response, nil
+}
+
+// Puts at the current revision.
+func (s *fakeServer) put(request *pb.PutRequest) *pb.PutResponse {
+	response := &pb.PutResponse{Header: s.header()}
+	key := string(request.Key)
+	prev := s.kvs[key]
+	kv := &mvccpb.KeyValue{
+		Key:            request.Key,
+		Value:          request.Value,
+		CreateRevision: s.revision,
+		ModRevision:    s.revision,
+		Version:        1,
+		Lease:          request.Lease,
+	}
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+		if request.PrevKv {
+			response.PrevKv = prev
+		}
+	}
+	s.kvs[key] = kv
+	s.events = append(s.events, &mvccpb.Event{Type: mvccpb.PUT, Kv: kv, PrevKv: prev})
+	return response
+}
+
+func (s *fakeServer) DeleteRange(ctx context.Context, request *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.keys(request.Key, request.RangeEnd)) == 0 {
+		return &pb.DeleteRangeResponse{Header: s.header()}, nil
+	}
+	s.revision++
+	response := s.deleteRange(request)
+	s.notify()
+	return response, nil
+}
+
+// Deletes at the current revision.
+func (s *fakeServer) deleteRange(request *pb.DeleteRangeRequest) *pb.DeleteRangeResponse {
+	response := &pb.DeleteRangeResponse{Header: s.header()}
+	for _, key := range s.keys(request.Key, request.RangeEnd) {
+		prev := s.kvs[key]
+		delete(s.kvs, key)
+		s.events = append(s.events, &mvccpb.Event{
+			Type:   mvccpb.DELETE,
+			Kv:     &mvccpb.KeyValue{Key: prev.Key, ModRevision: s.revision},
+			PrevKv: prev,
+		})
+		response.Deleted++
+		if request.PrevKv {
+			response.PrevKvs = append(response.PrevKvs, prev)
+		}
+	}
+	return response
+}
+
+func (s *fakeServer) Txn(ctx context.Context, request *pb.TxnRequest) (*pb.TxnResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	response := &pb.TxnResponse{Succeeded: true}
+	for _, compare := range request.Compare {
+		if !s.compare(compare) {
+			response.Succeeded = false
+		}
+	}
+	ops := request.Success
+	if !response.Succeeded {
+		ops = request.Failure
+	}
+
+	// All the writes of a transaction share a revision
+	for _, op := range ops {
+		if op.GetRequestRange() == nil {
+			s.revision++
+			break
+		}
+	}
+	for _, op := range ops {
+		switch {
+		case op.GetRequestRange() != nil:
+			response.Responses = append(response.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseRange{ResponseRange: s.rangeKeys(op.GetRequestRange())},
+			})
+		case op.GetRequestPut() != nil:
+			response.Responses = append(response.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponsePut{ResponsePut: s.put(op.GetRequestPut())},
+			})
+		case op.GetRequestDeleteRange() != nil:
+			response.Responses = append(response.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: s.deleteRange(op.GetRequestDeleteRange())},
+			})
+		}
+	}
+	response.Header = s.header()
+	s.notify()
+	return response, nil
+}
+
+func (s *fakeServer) compare(compare *pb.Compare) bool {
+	kv := s.kvs[string(compare.Key)]
+	if kv == nil {
+		kv = &mvccpb.KeyValue{}
+	}
+
+	var result int
+	switch compare.Target {
+	case pb.Compare_VERSION:
+		result = compareInt(kv.Version, compare.GetVersion())
+	case pb.Compare_CREATE:
+		result = compareInt(kv.CreateRevision, compare.GetCreateRevision())
+	case pb.Compare_MOD:
+		result = compareInt(kv.ModRevision, compare.GetModRevision())
+	case pb.Compare_VALUE:
+		result = bytes.Compare(kv.Value, compare.GetValue())
+	case pb.Compare_LEASE:
+		result = compareInt(kv.Lease, compare.GetLease())
+	}
+
+	switch compare.Result {
+	case pb.Compare_EQUAL:
+		return result == 0
+	case pb.Compare_GREATER:
+		return result > 0
+	case pb.Compare_LESS:
+		return result < 0
+	default:
+		return result != 0
+	}
+}
+
+func compareInt(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (s *fakeServer) Compact(ctx context.Context, request *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.compacted = request.Revision
+	var events []*mvccpb.Event
+	for _, event := range s.events {
+		if event.Kv.ModRevision > s.compacted {
+			events = append(events, event)
+		}
+	}
+	s.events = events
+	return &pb.CompactionResponse{Header: s.header()}, nil
+}
+
+func (s *fakeServer) LeaseGrant(ctx context.Context, request *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastLease++
+	s.leases[s.lastLease] = request.TTL
+	return &pb.LeaseGrantResponse{Header: s.header(), ID: s.lastLease, TTL: request.TTL}, nil
+}
+
+// Revokes a lease and deletes its keys, as when it expires.
+func (s *fakeServer) LeaseRevoke(ctx context.Context, request *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.leases[request.ID] == 0 {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	delete(s.leases, request.ID)
+
+	var keys []string
+	for key, kv := range s.kvs {
+		if kv.Lease == request.ID {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		s.revision++
+		for _, key := range keys {
+			s.deleteRange(&pb.DeleteRangeRequest{Key: []byte(key)})
+		}
+		s.notify()
+	}
+	return &pb.LeaseRevokeResponse{Header: s.header()}, nil
+}
+
+func (s *fakeServer) LeaseTimeToLive(ctx context.Context, request *pb.LeaseTimeToLiveRequest) (*pb.LeaseTimeToLiveResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ttl, ok := s.leases[request.ID]
+	if !ok {
+		return &pb.LeaseTimeToLiveResponse{Header: s.header(), ID: request.ID, TTL: -1}, nil
+	}
+	return &pb.LeaseTimeToLiveResponse{Header: s.header(), ID: request.ID, TTL: ttl, GrantedTTL: ttl}, nil
+}
+
+// Returns the channel closed on the next change.
+func (s *fakeServer) next() chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.changed
+}
+
+func (s *fakeServer) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Serves the watches created on stream until it is closed. Cancel requests
+// are ignored: the client drops the events of canceled watches.
+func (s *fakeServer) Watch(stream pb.Watch_WatchServer) error {
+	var sendLock sync.Mutex
+	send := func(response *pb.WatchResponse) error {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		return stream.Send(response)
+	}
+
+	var id int64
+	for {
+		request, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if create := request.GetCreateRequest(); create != nil {
+			go s.watch(stream.Context(), id, create, send)
+			id++
+		}
+	}
+}
+
+func (s *fakeServer) watch(ctx context.Context, id int64, create *pb.WatchCreateRequest, send func(*pb.WatchResponse) error) {
+	s.lock.Lock()
+	revision := create.StartRevision
+	if revision == 0 {
+		revision = s.revision + 1
+	}
+	created := &pb.WatchResponse{Header: s.header(), WatchId: id, Created: true}
+	compacted := s.compacted
+	s.lock.Unlock()
+
+	if send(created) != nil {
+		return
+	}
+	if revision <= compacted {
+		send(&pb.WatchResponse{Header: created.Header, WatchId: id, CompactRevision: compacted, Canceled: true})
+		return
+	}
+
+	for {
+		changed := s.next()
+
+		s.lock.Lock()
+		response := &pb.WatchResponse{Header: s.header(), WatchId: id}
+		for _, event := range s.events {
+			if event.Kv.ModRevision >= revision && inRange(event.Kv.Key, create.Key, create.RangeEnd) {
+				response.Events = append(response.Events, event)
+			}
+		}
+		revision = s.revision + 1
+		s.lock.Unlock()
+
+		if len(response.Events) > 0 && send(response) != nil {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package goarken
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultBackoffInitial    = 500 * time.Millisecond
+	DefaultBackoffMax        = 30 * time.Second
+	DefaultBackoffMultiplier = 2
+	DefaultBackoffJitter     = 0.2
+)
+
+// Backoff is the policy of the delays between reconnections: the delay
+// starts at Initial and is multiplied by Multiplier after each failed attempt,
+// up to Max. Every delay is randomly shifted by up to Jitter times its value
+// so that clients don't reconnect in lockstep. Zero fields take their default
+// value.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Between 0 and 1
+	Jitter float64
+}
+
+// Delay returns the delay before the given attempt, starting at 0.
+func (b Backoff) Delay(attempt int) time.Duration {
+	b = b.withDefaults()
+
+	delay := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt))
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	return time.Duration(delay)
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = DefaultBackoffInitial
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoffMax
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = DefaultBackoffMultiplier
+	}
+	if b.Jitter <= 0 || b.Jitter > 1 {
+		b.Jitter = DefaultBackoffJitter
+	}
+	return b
+}
@@ -0,0 +1,42 @@
+package goarken
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func Test_Backoff(t *testing.T) {
+
+	Convey("Given a backoff policy", t, func() {
+		backoff := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: 0.1}
+
+		Convey("Then the delay grows exponentially with some jitter", func() {
+			So(backoff.Delay(0), ShouldBeBetweenOrEqual, 90*time.Millisecond, 110*time.Millisecond)
+			So(backoff.Delay(1), ShouldBeBetweenOrEqual, 180*time.Millisecond, 220*time.Millisecond)
+			So(backoff.Delay(3), ShouldBeBetweenOrEqual, 720*time.Millisecond, 880*time.Millisecond)
+		})
+
+		Convey("Then the delay never exceeds the maximum", func() {
+			So(backoff.Delay(10), ShouldBeBetweenOrEqual, 900*time.Millisecond, time.Second)
+			So(backoff.Delay(1000), ShouldBeLessThanOrEqualTo, time.Second)
+		})
+
+		Convey("Then the delays are not in lockstep", func() {
+			delays := make(map[time.Duration]bool)
+			for i := 0; i < 10; i++ {
+				delays[backoff.Delay(2)] = true
+			}
+			So(len(delays), ShouldBeGreaterThan, 1)
+		})
+	})
+
+	Convey("Given the default backoff policy", t, func() {
+		backoff := Backoff{}
+
+		Convey("Then it starts with the default delay", func() {
+			So(backoff.Delay(0), ShouldBeLessThanOrEqualTo, DefaultBackoffInitial+DefaultBackoffInitial/4)
+			So(backoff.Delay(100), ShouldBeLessThanOrEqualTo, DefaultBackoffMax)
+		})
+	})
+}
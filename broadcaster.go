@@ -1,25 +1,341 @@
 package goarken
 
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy tells what a Broadcaster does when the buffer of a
+// subscriber is full.
+type OverflowPolicy int
+
+const (
+	// Queue the events the buffer can't hold until the subscriber reads
+	// them, no event is lost. The queue is not bounded.
+	Block OverflowPolicy = iota
+	// Discard the oldest buffered event to make room for the new one.
+	DropOldest
+	// Discard the new event.
+	DropNewest
+	// Wait for the subscriber up to Timeout, then discard the new event.
+	BlockWithTimeout
+	// Close the subscription.
+	Disconnect
+)
+
+const (
+	DefaultBufferSize     = 100
+	DefaultOverflowPolicy = Block
+	DefaultBlockTimeout   = time.Second
+)
+
+// SubscriberOptions configure the delivery of events to a subscriber.
+type SubscriberOptions struct {
+	BufferSize int
+	Policy     OverflowPolicy
+	// Maximum wait of the BlockWithTimeout policy.
+	Timeout time.Duration
+	// Only the events selected by Filter are delivered, all of them if nil.
+	Filter EventFilter
+}
+
+// DefaultSubscriberOptions are the options of Listen.
+func DefaultSubscriberOptions() SubscriberOptions {
+	return SubscriberOptions{
+		BufferSize: DefaultBufferSize,
+		Policy:     DefaultOverflowPolicy,
+		Timeout:    DefaultBlockTimeout,
+	}
+}
+
+// A Subscription receives the events written to a Broadcaster on C, until
+// it is closed.
+type Subscription struct {
+	C chan *Event
+
+	broadcaster *Broadcaster
+	options     SubscriberOptions
+	dropped     uint64
+	closed      bool
+	// Serializes the deliveries to the subscriber
+	lock sync.Mutex
+	// Closed first, to interrupt a blocked delivery
+	done     chan struct{}
+	doneOnce sync.Once
+	// Events queued for a Block subscriber, sent in order by a forwarding
+	// goroutine while there are some
+	pending    []*Event
+	forwarding bool
+	forwarders sync.WaitGroup
+}
+
+// Close unsubscribes and closes C. It can be called several times, and
+// concurrently with Write.
+func (s *Subscription) Close() {
+	s.doneOnce.Do(func() { close(s.done) })
+	s.broadcaster.remove(s)
+	s.close()
+}
+
+// Dropped returns the number of events the subscriber has missed because
+// its buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Delivers an event according to the overflow policy. Returns false if the
+// subscription has to be disconnected.
+func (s *Subscription) deliver(event *Event) bool {
+	if s.options.Filter != nil && !s.options.Filter(event) {
+		return true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return true
+	}
+	if len(s.pending) > 0 {
+		// Keep the events in order
+		s.queue(event)
+		return true
+	}
+
+	select {
+	case s.C <- event:
+		return true
+	default:
+	}
+
+	switch s.options.Policy {
+	case Block:
+		s.queue(event)
+		return true
+
+	case DropOldest:
+		if cap(s.C) == 0 {
+			// Nothing buffered to drop
+			atomic.AddUint64(&s.dropped, 1)
+			return true
+		}
+		for {
+			select {
+			case <-s.C:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+			select {
+			case s.C <- event:
+				return true
+			default:
+			}
+		}
+
+	case BlockWithTimeout:
+		timer := time.NewTimer(s.options.Timeout)
+		defer timer.Stop()
+		select {
+		case s.C <- event:
+		case <-timer.C:
+			atomic.AddUint64(&s.dropped, 1)
+		case <-s.done:
+		}
+		return true
+
+	case Disconnect:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return true
+	}
+}
+
+// Queues an event for a Block subscriber. Must be called with the lock
+// held.
+func (s *Subscription) queue(event *Event) {
+	s.pending = append(s.pending, event)
+	if !s.forwarding {
+		s.forwarding = true
+		s.forwarders.Add(1)
+		go s.forward()
+	}
+}
+
+// Sends the queued events until there is none left, or the subscription is
+// closed.
+func (s *Subscription) forward() {
+	defer s.forwarders.Done()
+	for {
+		s.lock.Lock()
+		if s.closed || len(s.pending) == 0 {
+			s.pending = nil
+			s.forwarding = false
+			s.lock.Unlock()
+			return
+		}
+		event := s.pending[0]
+		s.lock.Unlock()
+
+		// C is only closed once the forwarder has returned
+		select {
+		case s.C <- event:
+		case <-s.done:
+			s.lock.Lock()
+			s.pending = nil
+			s.forwarding = false
+			s.lock.Unlock()
+			return
+		}
+
+		s.lock.Lock()
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.lock.Unlock()
+	}
+}
+
+// Closes the channel of the subscription, once, after its forwarder has
+// returned.
+func (s *Subscription) close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	s.forwarders.Wait()
+	close(s.C)
+}
+
+// A Broadcaster sends every event written to it to all its subscribers.
+// Writing only waits for the BlockWithTimeout subscribers whose buffer is
+// full, up to their timeout: the events of the Block ones are queued.
 type Broadcaster struct {
-	listeners []chan interface{}
+	subscriptions []*Subscription
+	closed        bool
+	lock          sync.RWMutex
 }
 
 func NewBroadcaster() *Broadcaster {
 	b := &Broadcaster{
-		listeners: []chan interface{}{},
+		subscriptions: []*Subscription{},
 	}
 	return b
 }
 
-func (b *Broadcaster) Write(message interface{}) {
-	for _, channel := range b.listeners {
-		channel <- message
+func (b *Broadcaster) Write(message *Event) {
+	b.lock.RLock()
+	subscriptions := make([]*Subscription, len(b.subscriptions))
+	copy(subscriptions, b.subscriptions)
+	b.lock.RUnlock()
+
+	for _, subscription := range subscriptions {
+		if !subscription.deliver(message) {
+			subscription.Close()
+		}
+	}
+}
+
+// Listen subscribes with the default options and returns the channel of the
+// subscription.
+func (b *Broadcaster) Listen() chan *Event {
+	return b.Subscribe(DefaultSubscriberOptions()).C
+}
+
+// Subscribe adds a subscriber receiving events according to options.
+func (b *Broadcaster) Subscribe(options SubscriberOptions) *Subscription {
+	if options.BufferSize < 0 {
+		options.BufferSize = 0
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultBlockTimeout
+	}
+
+	subscription := &Subscription{
+		C:           make(chan *Event, options.BufferSize),
+		broadcaster: b,
+		options:     options,
+		done:        make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	closed := b.closed
+	if !closed {
+		b.subscriptions = append(b.subscriptions, subscription)
+	}
+	b.lock.Unlock()
+
+	if closed {
+		subscription.Close()
+	}
+	return subscription
+}
+
+// Close closes every subscription. Later subscriptions are closed right away.
+func (b *Broadcaster) Close() {
+	b.lock.Lock()
+	subscriptions := b.subscriptions
+	b.subscriptions = nil
+	b.closed = true
+	b.lock.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.Close()
 	}
 }
 
-func (b *Broadcaster) Listen() chan interface{} {
-	channel := make(chan interface{})
-	b.listeners = append(b.listeners, channel)
-	return channel
+// ListenFiltered subscribes with the default options and filter, and returns
+// the channel of the subscription.
+func (b *Broadcaster) ListenFiltered(filter EventFilter) chan *Event {
+	options := DefaultSubscriberOptions()
+	options.Filter = filter
+	return b.Subscribe(options).C
+}
+
+// ListenContext is like Listen, the subscription is closed when ctx is
+// done.
+func (b *Broadcaster) ListenContext(ctx context.Context) chan *Event {
+	return b.SubscribeContext(ctx, DefaultSubscriberOptions()).C
+}
+
+// SubscribeContext is like Subscribe, the subscription is closed when ctx is
+// done.
+func (b *Broadcaster) SubscribeContext(ctx context.Context, options SubscriberOptions) *Subscription {
+	subscription := b.Subscribe(options)
+	go func() {
+		select {
+		case <-ctx.Done():
+			subscription.Close()
+		case <-subscription.done:
+		}
+	}()
+	return subscription
+}
+
+// Subscriptions returns the current subscriptions, e.g. to monitor their
+// dropped events.
+func (b *Broadcaster) Subscriptions() []*Subscription {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	subscriptions := make([]*Subscription, len(b.subscriptions))
+	copy(subscriptions, b.subscriptions)
+	return subscriptions
+}
 
+func (b *Broadcaster) remove(subscription *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, s := range b.subscriptions {
+		if s == subscription {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			return
+		}
+	}
 }
@@ -1,9 +1,11 @@
 package goarken
 
 import (
+	"context"
 	. "github.com/smartystreets/goconvey/convey"
 	"sync"
 	"testing"
+	"time"
 )
 
 type Listener struct {
@@ -44,7 +46,7 @@ func Test_Broadcaster(t *testing.T) {
 		So(l3.HasBeenCalled, ShouldEqual, false)
 
 		Convey("When one send an event to it", func() {
-			b.Write(&struct{}{})
+			b.Write(&Event{})
 			wg.Wait()
 
 			Convey("Then the listener has received the message", func() {
@@ -58,3 +60,152 @@ func Test_Broadcaster(t *testing.T) {
 	})
 
 }
+
+func Test_BroadcasterOverflow(t *testing.T) {
+
+	var b *Broadcaster
+
+	Convey("Given a broadcaster with slow subscribers", t, func() {
+		b = NewBroadcaster()
+
+		oldest := b.Subscribe(SubscriberOptions{BufferSize: 2, Policy: DropOldest})
+		newest := b.Subscribe(SubscriberOptions{BufferSize: 2, Policy: DropNewest})
+		blocking := b.Subscribe(SubscriberOptions{BufferSize: 2, Policy: BlockWithTimeout, Timeout: 10 * time.Millisecond})
+		disconnected := b.Subscribe(SubscriberOptions{BufferSize: 2, Policy: Disconnect})
+
+		Convey("When more events than their buffer are written", func() {
+			for i := uint64(1); i <= 3; i++ {
+				b.Write(&Event{Index: i})
+			}
+
+			Convey("Then drop-oldest subscribers keep the latest events", func() {
+				So((<-oldest.C).Index, ShouldEqual, 2)
+				So((<-oldest.C).Index, ShouldEqual, 3)
+				So(oldest.Dropped(), ShouldEqual, 1)
+			})
+
+			Convey("Then drop-newest subscribers keep the first events", func() {
+				So((<-newest.C).Index, ShouldEqual, 1)
+				So((<-newest.C).Index, ShouldEqual, 2)
+				So(newest.Dropped(), ShouldEqual, 1)
+			})
+
+			Convey("Then blocking subscribers drop events after the timeout", func() {
+				So((<-blocking.C).Index, ShouldEqual, 1)
+				So((<-blocking.C).Index, ShouldEqual, 2)
+				So(blocking.Dropped(), ShouldEqual, 1)
+			})
+
+			Convey("Then disconnecting subscribers are closed", func() {
+				So((<-disconnected.C).Index, ShouldEqual, 1)
+				So((<-disconnected.C).Index, ShouldEqual, 2)
+				_, ok := <-disconnected.C
+				So(ok, ShouldBeFalse)
+				So(len(b.Subscriptions()), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When a default subscriber reads slowly", func() {
+			slow := NewBroadcaster()
+			subscription := slow.Subscribe(DefaultSubscriberOptions())
+			done := make(chan bool)
+			go func() {
+				for i := uint64(1); i <= 2*DefaultBufferSize; i++ {
+					slow.Write(&Event{Index: i})
+				}
+				close(done)
+			}()
+
+			Convey("Then writing does not wait for it and no event is lost", func() {
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					So("blocked", ShouldEqual, "done")
+				}
+
+				for i := uint64(1); i <= 2*DefaultBufferSize; i++ {
+					So((<-subscription.C).Index, ShouldEqual, i)
+				}
+				So(subscription.Dropped(), ShouldEqual, 0)
+			})
+
+			Convey("Then the other subscribers are not held up", func() {
+				<-done
+				other := slow.Subscribe(DefaultSubscriberOptions())
+				slow.Write(&Event{Index: 0})
+				So((<-other.C).Index, ShouldEqual, 0)
+			})
+
+			Convey("Then closing it closes its channel", func() {
+				<-done
+				subscription.Close()
+				count := 0
+				for range subscription.C {
+					count++
+				}
+				So(count, ShouldBeLessThanOrEqualTo, 2*DefaultBufferSize)
+			})
+		})
+	})
+}
+
+func Test_BroadcasterUnsubscribe(t *testing.T) {
+
+	var b *Broadcaster
+
+	Convey("Given a broadcaster with a subscriber", t, func() {
+		b = NewBroadcaster()
+		subscription := b.Subscribe(DefaultSubscriberOptions())
+
+		Convey("When the subscription is closed", func() {
+			subscription.Close()
+			subscription.Close()
+			b.Write(&Event{})
+
+			Convey("Then its channel is closed and it is not subscribed anymore", func() {
+				_, ok := <-subscription.C
+				So(ok, ShouldBeFalse)
+				So(len(b.Subscriptions()), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the context of a subscriber is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			channel := b.ListenContext(ctx)
+			cancel()
+
+			Convey("Then its channel is closed", func() {
+				select {
+				case _, ok := <-channel:
+					So(ok, ShouldBeFalse)
+				case <-time.After(time.Second):
+					So("timeout", ShouldEqual, "closed")
+				}
+				So(len(b.Subscriptions()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When subscribers are closed while events are written", func() {
+			go func() {
+				for range subscription.C {
+				}
+			}()
+			done := make(chan bool)
+			go func() {
+				defer close(done)
+				for i := 0; i < 1000; i++ {
+					b.Write(&Event{})
+				}
+			}()
+			for i := 0; i < 100; i++ {
+				s := b.Subscribe(SubscriberOptions{BufferSize: 1, Policy: BlockWithTimeout})
+				s.Close()
+			}
+			<-done
+
+			Convey("Then only the open subscriber is left", func() {
+				So(len(b.Subscriptions()), ShouldEqual, 1)
+			})
+		})
+	})
+}
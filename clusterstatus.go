@@ -0,0 +1,92 @@
+package goarken
+
+// Status of a service cluster where some instances are started, but not all.
+const DEGRADED_STATUS = "degraded"
+
+// A ClusterStatus is the status of a service cluster, derived from the
+// computed statuses of its instances:
+//   - STARTED_STATUS when all the instances are started
+//   - DEGRADED_STATUS when some of them are started
+//   - STARTING_STATUS when none is started and some are starting
+//   - PASSIVATED_STATUS when all of them are passivated
+//   - STOPPED_STATUS when all of them are stopped or passivated
+//   - ERROR_STATUS otherwise
+//   - NA_STATUS when the cluster has no instance
+type ClusterStatus struct {
+	Status string `json:"status"`
+	// Number of instances by computed status
+	Counts map[string]int `json:"counts"`
+}
+
+// Status returns the aggregated status of the instances of the cluster.
+func (cl *ServiceCluster) Status() *ClusterStatus {
+	status := &ClusterStatus{Counts: make(map[string]int)}
+	instances := cl.GetInstances()
+	for _, instance := range instances {
+		status.Counts[instance.Status.Compute()]++
+	}
+
+	total := len(instances)
+	counts := status.Counts
+	switch {
+	case total == 0:
+		status.Status = NA_STATUS
+	case counts[STARTED_STATUS] == total:
+		status.Status = STARTED_STATUS
+	case counts[STARTED_STATUS] > 0:
+		status.Status = DEGRADED_STATUS
+	case counts[STARTING_STATUS] > 0:
+		status.Status = STARTING_STATUS
+	case counts[PASSIVATED_STATUS] == total:
+		status.Status = PASSIVATED_STATUS
+	case counts[STOPPED_STATUS]+counts[PASSIVATED_STATUS] == total:
+		status.Status = STOPPED_STATUS
+	default:
+		status.Status = ERROR_STATUS
+	}
+	return status
+}
+
+// Status of a cluster that is unknown or removed.
+func naClusterStatus() *ClusterStatus {
+	return &ClusterStatus{Status: NA_STATUS, Counts: make(map[string]int)}
+}
+
+// Broadcasts a ServiceClusterStatusChanged event if the aggregated status of
+// the cluster of a service event has changed. A cluster seen for the first
+// time changes from NA_STATUS, and a removed cluster changes to NA_STATUS.
+func (w *Watcher) checkClusterStatus(event *Event) {
+	if !event.IsServiceEvent() || event.Type == ServiceClusterStatusChanged || event.Cluster == nil {
+		return
+	}
+
+	w.clusterStatusLock.Lock()
+	if w.clusterStatuses == nil {
+		w.clusterStatuses = make(map[string]*ClusterStatus)
+	}
+	prev := w.clusterStatuses[event.Name]
+	if prev == nil {
+		prev = naClusterStatus()
+	}
+	var status *ClusterStatus
+	if event.Type == ServiceClusterRemoved {
+		status = naClusterStatus()
+		delete(w.clusterStatuses, event.Name)
+	} else {
+		status = event.Cluster.Status()
+		w.clusterStatuses[event.Name] = status
+	}
+	w.clusterStatusLock.Unlock()
+
+	if prev.Status != status.Status {
+		w.broadcaster.Write(&Event{
+			Type:              ServiceClusterStatusChanged,
+			Key:               event.Key,
+			Index:             event.Index,
+			Name:              event.Name,
+			Cluster:           event.Cluster,
+			PrevClusterStatus: prev,
+			ClusterStatus:     status,
+		})
+	}
+}
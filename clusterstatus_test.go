@@ -0,0 +1,149 @@
+package goarken
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func instanceWithStatus(index string, current string, expected string, alive string) *Service {
+	service := &Service{Index: index, Location: &Location{}}
+	service.Status = &Status{Current: current, Expected: expected, Alive: alive, Service: service}
+	return service
+}
+
+func Test_ClusterStatus(t *testing.T) {
+	var cluster *ServiceCluster
+
+	Convey("Given a service cluster", t, func() {
+		cluster = NewServiceCluster("my_service")
+
+		Convey("When it has no instance", func() {
+			Convey("Then its status is not available", func() {
+				So(cluster.Status().Status, ShouldEqual, NA_STATUS)
+			})
+		})
+
+		Convey("When all its instances are started", func() {
+			cluster.Add(instanceWithStatus("1", STARTED_STATUS, STARTED_STATUS, "1"))
+			cluster.Add(instanceWithStatus("2", STARTED_STATUS, STARTED_STATUS, "1"))
+
+			Convey("Then it is started", func() {
+				So(cluster.Status(), ShouldResemble, &ClusterStatus{
+					Status: STARTED_STATUS,
+					Counts: map[string]int{STARTED_STATUS: 2},
+				})
+			})
+		})
+
+		Convey("When some of its instances are started", func() {
+			cluster.Add(instanceWithStatus("1", STARTED_STATUS, STARTED_STATUS, "1"))
+			cluster.Add(instanceWithStatus("2", STARTED_STATUS, STARTED_STATUS, ""))
+
+			Convey("Then it is degraded", func() {
+				status := cluster.Status()
+				So(status.Status, ShouldEqual, DEGRADED_STATUS)
+				So(status.Counts[ERROR_STATUS], ShouldEqual, 1)
+			})
+		})
+
+		Convey("When its instances are starting or stopped", func() {
+			cluster.Add(instanceWithStatus("1", STARTING_STATUS, STARTED_STATUS, ""))
+			cluster.Add(instanceWithStatus("2", STOPPED_STATUS, STOPPED_STATUS, ""))
+
+			Convey("Then it is starting", func() {
+				So(cluster.Status().Status, ShouldEqual, STARTING_STATUS)
+			})
+		})
+
+		Convey("When its instances are passivated", func() {
+			cluster.Add(instanceWithStatus("1", PASSIVATED_STATUS, PASSIVATED_STATUS, ""))
+
+			Convey("Then it is passivated", func() {
+				So(cluster.Status().Status, ShouldEqual, PASSIVATED_STATUS)
+			})
+
+			Convey("Then it is stopped if others are stopped", func() {
+				cluster.Add(instanceWithStatus("2", STOPPED_STATUS, STOPPED_STATUS, ""))
+				So(cluster.Status().Status, ShouldEqual, STOPPED_STATUS)
+			})
+		})
+
+		Convey("When its instances are in error", func() {
+			cluster.Add(instanceWithStatus("1", STOPPED_STATUS, STARTED_STATUS, ""))
+			cluster.Add(instanceWithStatus("2", STOPPED_STATUS, STOPPED_STATUS, ""))
+
+			Convey("Then it is in error", func() {
+				So(cluster.Status().Status, ShouldEqual, ERROR_STATUS)
+			})
+		})
+	})
+}
+
+func Test_WatcherClusterStatus(t *testing.T) {
+	var w *Watcher
+	var client *MemoryBackend
+
+	Convey("Given a Watcher on a started service cluster", t, func() {
+		client = NewMemoryBackend()
+		for _, index := range []string{"1", "2"} {
+			client.Set("/services/my_service/"+index+"/status/expected", STARTED_STATUS, 0)
+			client.Set("/services/my_service/"+index+"/status/current", STARTED_STATUS, 0)
+			client.Set("/services/my_service/"+index+"/status/alive", "1", 0)
+		}
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Services:      make(map[string]*ServiceCluster),
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+		So(w.WaitForSync(context.Background()), ShouldBeNil)
+		updateChan := w.ListenFiltered(EventTypes(ServiceClusterStatusChanged))
+
+		Convey("When one of its instances is not alive anymore", func() {
+			client.Delete("/services/my_service/2/status/alive", false)
+			event, err := waitFor(updateChan, time.Second)
+			So(err, ShouldBeNil)
+
+			Convey("Then its status change is broadcast", func() {
+				So(event.Name, ShouldEqual, "my_service")
+				So(event.PrevClusterStatus.Status, ShouldEqual, STARTED_STATUS)
+				So(event.ClusterStatus.Status, ShouldEqual, DEGRADED_STATUS)
+				So(event.ClusterStatus.Counts, ShouldResemble, map[string]int{STARTED_STATUS: 1, ERROR_STATUS: 1})
+			})
+
+			Convey("Then changes keeping its status are not broadcast", func() {
+				client.Set("/services/my_service/2/lastAccess", "2016-03-01 10:00:00", 0)
+				_, err := waitFor(updateChan, 300*time.Millisecond)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When it is removed", func() {
+			client.Delete("/services/my_service", true)
+			event, err := waitFor(updateChan, time.Second)
+			So(err, ShouldBeNil)
+
+			Convey("Then its status changes to not available", func() {
+				So(event.Name, ShouldEqual, "my_service")
+				So(event.PrevClusterStatus.Status, ShouldEqual, STARTED_STATUS)
+				So(event.ClusterStatus.Status, ShouldEqual, NA_STATUS)
+			})
+		})
+
+		Convey("When another cluster is created", func() {
+			client.Set("/services/other_service/1/status/expected", STARTED_STATUS, 0)
+			event, err := waitFor(updateChan, time.Second)
+			So(err, ShouldBeNil)
+
+			Convey("Then its initial status is broadcast", func() {
+				So(event.Name, ShouldEqual, "other_service")
+				So(event.PrevClusterStatus.Status, ShouldEqual, NA_STATUS)
+				So(event.ClusterStatus.Status, ShouldNotEqual, NA_STATUS)
+			})
+		})
+	})
+}
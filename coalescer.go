@@ -0,0 +1,148 @@
+package goarken
+
+import (
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+// CoalesceStats counts the changes received by a coalescing Watcher.
+type CoalesceStats struct {
+	// Changes queued for a coalesced update
+	Received uint64
+	// Changes merged into an update triggered by a previous change
+	Merged uint64
+	// Coalesced updates applied
+	Flushes uint64
+}
+
+// Queues the changes of a key, like a service name, for a window of time
+// starting at its first change. The changes are then flushed together. When
+// the flush fails, they are queued again, before the ones received since.
+type coalescer struct {
+	window time.Duration
+	flush  func(key string, changes []*Response) error
+
+	pending map[string]*pendingChanges
+	stats   CoalesceStats
+	stopped bool
+	lock    sync.Mutex
+	// Serializes the flushes, so that changes are applied in order
+	flushLock sync.Mutex
+	flushes   sync.WaitGroup
+}
+
+type pendingChanges struct {
+	changes []*Response
+	timer   *time.Timer
+}
+
+func newCoalescer(window time.Duration, flush func(key string, changes []*Response) error) *coalescer {
+	return &coalescer{
+		window:  window,
+		flush:   flush,
+		pending: make(map[string]*pendingChanges),
+	}
+}
+
+// Queues a change of key.
+func (c *coalescer) add(key string, change *Response) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stopped {
+		return
+	}
+
+	c.stats.Received++
+	if pending := c.pending[key]; pending != nil {
+		c.stats.Merged++
+		pending.changes = append(pending.changes, change)
+		return
+	}
+	c.schedule(key, []*Response{change})
+}
+
+// Queues changes of key that has none pending, must be called with the lock
+// held.
+func (c *coalescer) schedule(key string, changes []*Response) {
+	c.flushes.Add(1)
+	c.pending[key] = &pendingChanges{
+		changes: changes,
+		timer: time.AfterFunc(c.window, func() {
+			defer c.flushes.Done()
+			c.flushKey(key)
+		}),
+	}
+}
+
+// Queues again the changes of key whose flush failed.
+func (c *coalescer) retry(key string, changes []*Response) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stopped {
+		return
+	}
+	if pending := c.pending[key]; pending != nil {
+		pending.changes = append(changes, pending.changes...)
+		return
+	}
+	c.schedule(key, changes)
+}
+
+// Flushes the changes of key right away, if any.
+func (c *coalescer) flushNow(key string) {
+	c.lock.Lock()
+	pending := c.pending[key]
+	if pending != nil && pending.timer.Stop() {
+		c.flushes.Done()
+	}
+	c.lock.Unlock()
+
+	// If the timer has fired, this waits for its flush
+	if pending != nil {
+		c.flushKey(key)
+	}
+}
+
+func (c *coalescer) flushKey(key string) {
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+
+	c.lock.Lock()
+	pending := c.pending[key]
+	delete(c.pending, key)
+	if pending != nil {
+		c.stats.Flushes++
+	}
+	c.lock.Unlock()
+
+	if pending != nil {
+		if err := c.flush(key, pending.changes); err != nil {
+			glog.Errorf("Unable to apply the changes of %s, retrying them : %v", key, err)
+			c.retry(key, pending.changes)
+		}
+	}
+}
+
+// Drops the queued changes and waits for the running flushes.
+func (c *coalescer) stop() {
+	c.lock.Lock()
+	c.stopped = true
+	for key, pending := range c.pending {
+		if pending.timer.Stop() {
+			c.flushes.Done()
+			delete(c.pending, key)
+		}
+	}
+	c.lock.Unlock()
+
+	c.flushes.Wait()
+}
+
+func (c *coalescer) getStats() CoalesceStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
@@ -0,0 +1,96 @@
+package goarken
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func Test_WatcherCoalescing(t *testing.T) {
+	var w *Watcher
+	var client *MemoryBackend
+
+	Convey("Given a Watcher coalescing the changes of services", t, func() {
+		client = NewMemoryBackend()
+		w = &Watcher{
+			Client:         client,
+			DomainPrefix:   "/domains",
+			ServicePrefix:  "/services",
+			Services:       make(map[string]*ServiceCluster),
+			CoalesceWindow: 200 * time.Millisecond,
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+		So(w.WaitForSync(context.Background()), ShouldBeNil)
+		updateChan := w.ListenFiltered(EventTypes(ServiceInstanceAdded, ServiceInstanceUpdated, ServiceInstanceRemoved))
+
+		Convey("When an instance is started with several writes", func() {
+			client.Set("/services/my_service/1/location", `{"host":"127.0.0.1","port":8080}`, 0)
+			client.Set("/services/my_service/1/status/expected", STARTED_STATUS, 0)
+			client.Set("/services/my_service/1/status/current", STARTED_STATUS, 0)
+			client.Set("/services/my_service/1/status/alive", "1", 0)
+			client.Set("/services/my_service/1/lastAccess", "2015-01-01 00:00:00", 0)
+
+			Convey("Then a single event is broadcast", func() {
+				event, _ := waitFor(updateChan, time.Second)
+				So(event.Type, ShouldEqual, ServiceInstanceAdded)
+				So(event.Service.Status.Compute(), ShouldEqual, STARTED_STATUS)
+
+				_, err := waitFor(updateChan, 400*time.Millisecond)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then the merged changes are counted", func() {
+				waitFor(updateChan, time.Second)
+				stats := w.CoalesceStats()
+				So(stats.Received, ShouldEqual, 5)
+				So(stats.Merged, ShouldEqual, 4)
+				So(stats.Flushes, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When an instance is removed right after being added", func() {
+			client.Set("/services/my_service/1/domain", "mydomain.com", 0)
+			client.Set("/services/my_service/2/domain", "mydomain.com", 0)
+			client.Delete("/services/my_service/2", true)
+
+			Convey("Then the removed instance is never broadcast", func() {
+				event, _ := waitFor(updateChan, time.Second)
+				So(event.Type, ShouldEqual, ServiceInstanceAdded)
+				So(event.Service.Index, ShouldEqual, "1")
+
+				_, err := waitFor(updateChan, 400*time.Millisecond)
+				So(err, ShouldNotBeNil)
+				So(len(w.GetServiceCluster("my_service").GetInstances()), ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Given a coalescing Watcher whose backend fails a read", t, func() {
+		client := &failingGetBackend{MemoryBackend: NewMemoryBackend()}
+		w = &Watcher{
+			Client:         client,
+			DomainPrefix:   "/domains",
+			ServicePrefix:  "/services",
+			Services:       make(map[string]*ServiceCluster),
+			CoalesceWindow: 100 * time.Millisecond,
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+		So(w.WaitForSync(context.Background()), ShouldBeNil)
+		updateChan := w.ListenFiltered(EventTypes(ServiceInstanceAdded))
+
+		Convey("When the changes of a service are flushed", func() {
+			client.failGet("/services/my_service")
+			client.Set("/services/my_service/1/domain", "mydomain.com", 0)
+
+			Convey("Then they are applied by a retry", func() {
+				event, err := waitFor(updateChan, time.Second)
+				So(err, ShouldBeNil)
+				So(event.Service.Domain, ShouldEqual, "mydomain.com")
+				So(w.CoalesceStats().Flushes, ShouldEqual, 2)
+			})
+		})
+	})
+}
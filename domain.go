@@ -1,9 +1,9 @@
 package goarken
 
 import (
-	"github.com/coreos/go-etcd/etcd"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 type Domain struct {
@@ -12,10 +12,11 @@ type Domain struct {
 }
 
 var (
-	domainRegexp = regexp.MustCompile("/domain/(.*)(/.*)*")
+	domainRegexp     = regexp.MustCompile("/domain/(.*)(/.*)*")
+	domainRegexpLock sync.RWMutex
 )
 
-func NewDomain(domainNode *etcd.Node) *Domain {
+func NewDomain(domainNode *Node) *Domain {
 	domain := &Domain{}
 	domainKey := domainNode.Key
 	for _, node := range domainNode.Nodes {
@@ -31,11 +32,20 @@ func NewDomain(domainNode *etcd.Node) *Domain {
 }
 
 func SetDomainPrefix(domainPrefix string) {
+	domainRegexpLock.Lock()
+	defer domainRegexpLock.Unlock()
 	domainRegexp = regexp.MustCompile(domainPrefix + "/(.*)(/.*)*")
 }
 
-func getDomainForNode(node *etcd.Node) string {
-	return strings.Split(domainRegexp.FindStringSubmatch(node.Key)[1], "/")[0]
+// The prefix may be changed while watchers match their keys.
+func matchDomainRegexp(key string) []string {
+	domainRegexpLock.RLock()
+	defer domainRegexpLock.RUnlock()
+	return domainRegexp.FindStringSubmatch(key)
+}
+
+func getDomainForNode(node *Node) string {
+	return strings.Split(matchDomainRegexp(node.Key)[1], "/")[0]
 }
 
 func (domain *Domain) Equals(other *Domain) bool {
@@ -0,0 +1,296 @@
+package goarken
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Types of domains
+const (
+	// The domain is served by the service cluster named by its value.
+	SERVICE_DOMAIN = "service"
+	// The domain is proxied to the URI of its value.
+	URI_DOMAIN = "uri"
+)
+
+const maxHostnameLength = 253
+
+// Lower case labels of letters, digits and hyphens, separated by dots.
+var hostnameRegexp = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// An InvalidDomainError is returned when a domain can't be written as is.
+type InvalidDomainError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidDomainError) Error() string {
+	return "Invalid domain " + e.Name + ": " + e.Reason
+}
+
+// A DanglingReference is a domain serving a missing service cluster, or a
+// service instance declaring a missing domain.
+type DanglingReference struct {
+	// Key holding the reference
+	Key     string
+	Domain  string
+	Service string
+}
+
+func (d *DanglingReference) String() string {
+	return d.Key + ": " + d.Domain + " -> " + d.Service
+}
+
+// A DomainRepository writes domains to a backend, with the key layout read
+// by NewDomain, after validating them.
+type DomainRepository struct {
+	Client Backend
+	// Prefixes of the domains and services, /domains and /services by
+	// default.
+	Prefix        string
+	ServicePrefix string
+}
+
+func NewDomainRepository(client Backend, prefix string, servicePrefix string) *DomainRepository {
+	return &DomainRepository{Client: client, Prefix: prefix, ServicePrefix: servicePrefix}
+}
+
+// ValidateHostname checks that name is a lower case hostname.
+func ValidateHostname(name string) error {
+	if len(name) > maxHostnameLength || !hostnameRegexp.MatchString(name) {
+		return &InvalidDomainError{Name: name, Reason: "malformed hostname"}
+	}
+	return nil
+}
+
+// Validate checks the name, the type and the value of a domain. The service
+// cluster of a service domain must exist.
+func (r *DomainRepository) Validate(name string, domain *Domain) error {
+	if err := ValidateHostname(name); err != nil {
+		return err
+	}
+	if domain == nil {
+		return &InvalidDomainError{Name: name, Reason: "no type and value"}
+	}
+
+	switch domain.Typ {
+	case SERVICE_DOMAIN:
+		if domain.Value == "" || strings.Contains(domain.Value, "/") {
+			return &InvalidDomainError{Name: name, Reason: fmt.Sprintf("invalid service name %q", domain.Value)}
+		}
+		_, err := r.Client.Get(r.servicePrefix()+"/"+domain.Value, false)
+		if err == ErrKeyNotFound {
+			return &InvalidDomainError{Name: name, Reason: "service " + domain.Value + " does not exist"}
+		}
+		return err
+
+	case URI_DOMAIN:
+		uri, err := url.Parse(domain.Value)
+		if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+			return &InvalidDomainError{Name: name, Reason: fmt.Sprintf("invalid URI %q", domain.Value)}
+		}
+		return nil
+
+	default:
+		return &InvalidDomainError{Name: name, Reason: fmt.Sprintf("unknown type %q", domain.Typ)}
+	}
+}
+
+// CreateDomain writes a new domain. A ConflictError is returned if the
+// domain exists. Its keys are written in a single transaction when the
+// backend is a TxnBackend. Otherwise, if the type can't be written, the
+// value written before is removed.
+func (r *DomainRepository) CreateDomain(name string, domain *Domain) error {
+	if err := r.Validate(name, domain); err != nil {
+		return err
+	}
+
+	domainKey := r.prefix() + "/" + name
+	if _, err := r.Client.Get(domainKey, false); err != ErrKeyNotFound {
+		if err == nil {
+			return &ConflictError{Key: domainKey}
+		}
+		return err
+	}
+
+	if client, ok := r.Client.(TxnBackend); ok {
+		_, err := client.Txn([]*TxnOp{
+			{Key: domainKey + "/type", Value: domain.Typ, Create: true},
+			{Key: domainKey + "/value", Value: domain.Value, Create: true},
+		})
+		return conflict(domainKey, err)
+	}
+
+	if _, err := r.Client.Create(domainKey+"/value", domain.Value, 0); err != nil {
+		return conflict(domainKey+"/value", err)
+	}
+	if _, err := r.Client.Create(domainKey+"/type", domain.Typ, 0); err != nil {
+		// Only the key created here is removed, the type belongs to
+		// whoever wrote it
+		r.Client.Delete(domainKey+"/value", false)
+		return conflict(domainKey+"/type", err)
+	}
+	return nil
+}
+
+// UpdateDomain changes a domain read as prev. A ConflictError is returned if
+// it has been modified since, including the fields that are not changed. Its
+// keys are written in a single transaction when the backend is a TxnBackend.
+// Otherwise the unchanged fields are checked first, and the keys already
+// written are restored.
+func (r *DomainRepository) UpdateDomain(name string, prev *Domain, domain *Domain) error {
+	if err := r.Validate(name, domain); err != nil {
+		return err
+	}
+	if prev == nil {
+		return &ConflictError{Key: r.prefix() + "/" + name}
+	}
+
+	domainKey := r.prefix() + "/" + name
+	fields := []struct {
+		key, prev, value string
+	}{
+		{domainKey + "/type", prev.Typ, domain.Typ},
+		{domainKey + "/value", prev.Value, domain.Value},
+	}
+
+	if client, ok := r.Client.(TxnBackend); ok {
+		var ops []*TxnOp
+		for _, field := range fields {
+			ops = append(ops, &TxnOp{
+				Key:       field.key,
+				Value:     field.value,
+				Create:    field.prev == "",
+				PrevValue: field.prev,
+				CheckOnly: field.prev == field.value,
+			})
+		}
+		_, err := client.Txn(ops)
+		return conflict(domainKey, err)
+	}
+
+	for _, field := range fields {
+		if field.prev != field.value {
+			continue
+		}
+		response, err := r.Client.Get(field.key, false)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		if (err == ErrKeyNotFound) != (field.prev == "") || (err == nil && response.Node.Value != field.prev) {
+			return &ConflictError{Key: field.key}
+		}
+	}
+
+	var written []int
+	for i, field := range fields {
+		if field.prev == field.value {
+			continue
+		}
+		if err := r.swap(field.key, field.prev, field.value); err != nil {
+			for _, j := range written {
+				r.swap(fields[j].key, fields[j].value, fields[j].prev)
+			}
+			return err
+		}
+		written = append(written, i)
+	}
+	return nil
+}
+
+// DeleteDomain removes a domain, and returns the references to it that are
+// left dangling.
+func (r *DomainRepository) DeleteDomain(name string) ([]*DanglingReference, error) {
+	if err := ValidateHostname(name); err != nil {
+		return nil, err
+	}
+	if _, err := r.Client.Delete(r.prefix()+"/"+name, true); err != nil {
+		return nil, err
+	}
+
+	references, err := r.DanglingReferences()
+	if err != nil {
+		return nil, err
+	}
+	var dangling []*DanglingReference
+	for _, reference := range references {
+		if reference.Domain == name {
+			dangling = append(dangling, reference)
+		}
+	}
+	return dangling, nil
+}
+
+// DanglingReferences returns the service domains whose service cluster does
+// not exist, and the service instances whose domain does not exist, sorted by
+// key.
+func (r *DomainRepository) DanglingReferences() ([]*DanglingReference, error) {
+	domainLeaves, err := readLeaves(r.Client, r.prefix())
+	if err != nil {
+		return nil, err
+	}
+	serviceLeaves, err := readLeaves(r.Client, r.servicePrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make(map[string]bool)
+	for key := range domainLeaves {
+		domains[strings.SplitN(strings.TrimPrefix(key, r.prefix()+"/"), "/", 2)[0]] = true
+	}
+	services := make(map[string]bool)
+	for key := range serviceLeaves {
+		services[strings.SplitN(strings.TrimPrefix(key, r.servicePrefix()+"/"), "/", 2)[0]] = true
+	}
+
+	var references []*DanglingReference
+	for name := range domains {
+		typeKey, valueKey := r.prefix()+"/"+name+"/type", r.prefix()+"/"+name+"/value"
+		if domainLeaves[typeKey] == SERVICE_DOMAIN && !services[domainLeaves[valueKey]] {
+			references = append(references, &DanglingReference{Key: valueKey, Domain: name, Service: domainLeaves[valueKey]})
+		}
+	}
+	for key, value := range serviceLeaves {
+		parts := strings.Split(strings.TrimPrefix(key, r.servicePrefix()+"/"), "/")
+		if len(parts) == 3 && parts[2] == "domain" && value != "" && !domains[value] {
+			references = append(references, &DanglingReference{Key: key, Domain: value, Service: parts[0]})
+		}
+	}
+
+	sort.Sort(referencesByKey(references))
+	return references, nil
+}
+
+// Writes value at key if it is still prev.
+func (r *DomainRepository) swap(key string, prev string, value string) error {
+	var err error
+	if prev == "" {
+		_, err = r.Client.Create(key, value, 0)
+	} else {
+		_, err = r.Client.CompareAndSwap(key, value, 0, prev, 0)
+	}
+	return conflict(key, err)
+}
+
+func (r *DomainRepository) prefix() string {
+	if r.Prefix == "" {
+		return "/domains"
+	}
+	return r.Prefix
+}
+
+func (r *DomainRepository) servicePrefix() string {
+	if r.ServicePrefix == "" {
+		return "/services"
+	}
+	return r.ServicePrefix
+}
+
+type referencesByKey []*DanglingReference
+
+func (d referencesByKey) Len() int           { return len(d) }
+func (d referencesByKey) Less(i, j int) bool { return d[i].Key < d[j].Key }
+func (d referencesByKey) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
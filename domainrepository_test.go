@@ -0,0 +1,189 @@
+package goarken
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func Test_ValidateHostname(t *testing.T) {
+	Convey("Given hostnames", t, func() {
+		Convey("Then well formed ones are accepted", func() {
+			So(ValidateHostname("mydomain.com"), ShouldBeNil)
+			So(ValidateHostname("my-tenant.nuxeo.io"), ShouldBeNil)
+			So(ValidateHostname("localhost"), ShouldBeNil)
+		})
+
+		Convey("Then malformed ones are rejected", func() {
+			So(ValidateHostname(""), ShouldNotBeNil)
+			So(ValidateHostname("MyDomain.com"), ShouldNotBeNil)
+			So(ValidateHostname("mydomain.com."), ShouldNotBeNil)
+			So(ValidateHostname("-mydomain.com"), ShouldNotBeNil)
+			So(ValidateHostname("my_domain.com"), ShouldNotBeNil)
+			So(ValidateHostname("mydomain.com/path"), ShouldNotBeNil)
+			So(ValidateHostname(strings.Repeat("a", 64)+".com"), ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_DomainRepository(t *testing.T) {
+	var client *MemoryBackend
+	var repository *DomainRepository
+
+	Convey("Given a domain repository and a service", t, func() {
+		client = NewMemoryBackend()
+		client.Set("/services/my_service/1/domain", "mydomain.com", 0)
+		repository = NewDomainRepository(client, "", "")
+
+		Convey("When a service domain is created", func() {
+			err := repository.CreateDomain("mydomain.com", &Domain{Typ: SERVICE_DOMAIN, Value: "my_service"})
+			So(err, ShouldBeNil)
+
+			Convey("Then it can be read back", func() {
+				response, err := client.Get("/domains/mydomain.com", true)
+				So(err, ShouldBeNil)
+				So(NewDomain(response.Node), ShouldResemble, &Domain{Typ: SERVICE_DOMAIN, Value: "my_service"})
+				So(response.Node.Nodes[0].ModifiedIndex, ShouldEqual, response.Node.Nodes[1].ModifiedIndex)
+			})
+
+			Convey("Then it can't be created again", func() {
+				err := repository.CreateDomain("mydomain.com", &Domain{Typ: URI_DOMAIN, Value: "http://nuxeo.com"})
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+			})
+
+			Convey("Then it can be updated", func() {
+				err := repository.UpdateDomain("mydomain.com",
+					&Domain{Typ: SERVICE_DOMAIN, Value: "my_service"},
+					&Domain{Typ: URI_DOMAIN, Value: "https://nuxeo.com"})
+				So(err, ShouldBeNil)
+
+				response, _ := client.Get("/domains/mydomain.com", true)
+				So(NewDomain(response.Node), ShouldResemble, &Domain{Typ: URI_DOMAIN, Value: "https://nuxeo.com"})
+			})
+
+			Convey("Then an update based on a stale read is rejected and undone", func() {
+				client.Set("/domains/mydomain.com/value", "other_service", 0)
+				client.Set("/services/other_service/1/domain", "mydomain.com", 0)
+
+				err := repository.UpdateDomain("mydomain.com",
+					&Domain{Typ: SERVICE_DOMAIN, Value: "my_service"},
+					&Domain{Typ: URI_DOMAIN, Value: "https://nuxeo.com"})
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+
+				response, _ := client.Get("/domains/mydomain.com", true)
+				So(NewDomain(response.Node), ShouldResemble, &Domain{Typ: SERVICE_DOMAIN, Value: "other_service"})
+			})
+
+			Convey("Then an update of its value is rejected if its type changed since", func() {
+				client.Set("/domains/mydomain.com/type", URI_DOMAIN, 0)
+				client.Set("/services/other_service/1/domain", "mydomain.com", 0)
+
+				err := repository.UpdateDomain("mydomain.com",
+					&Domain{Typ: SERVICE_DOMAIN, Value: "my_service"},
+					&Domain{Typ: SERVICE_DOMAIN, Value: "other_service"})
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+
+				response, _ := client.Get("/domains/mydomain.com/value", false)
+				So(response.Node.Value, ShouldEqual, "my_service")
+			})
+
+			Convey("Then deleting it reports the services still using it", func() {
+				dangling, err := repository.DeleteDomain("mydomain.com")
+				So(err, ShouldBeNil)
+				So(len(dangling), ShouldEqual, 1)
+				So(dangling[0].Key, ShouldEqual, "/services/my_service/1/domain")
+				So(dangling[0].Service, ShouldEqual, "my_service")
+
+				_, err = client.Get("/domains/mydomain.com", true)
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+
+			Convey("Then deleting a domain without name deletes nothing", func() {
+				_, err := repository.DeleteDomain("")
+				So(err, ShouldHaveSameTypeAs, &InvalidDomainError{})
+
+				_, err = client.Get("/domains/mydomain.com", true)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When invalid domains are created", func() {
+			Convey("Then they are rejected", func() {
+				So(repository.CreateDomain("MyDomain.com", &Domain{Typ: SERVICE_DOMAIN, Value: "my_service"}), ShouldHaveSameTypeAs, &InvalidDomainError{})
+				So(repository.CreateDomain("mydomain.com", &Domain{Typ: "redirect", Value: "my_service"}), ShouldHaveSameTypeAs, &InvalidDomainError{})
+				So(repository.CreateDomain("mydomain.com", &Domain{Typ: SERVICE_DOMAIN, Value: "unknown_service"}), ShouldHaveSameTypeAs, &InvalidDomainError{})
+				So(repository.CreateDomain("mydomain.com", &Domain{Typ: URI_DOMAIN, Value: "nuxeo.com"}), ShouldHaveSameTypeAs, &InvalidDomainError{})
+
+				_, err := client.Get("/domains", true)
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+		})
+
+		Convey("When references are dangling", func() {
+			client.Set("/domains/other.com/type", SERVICE_DOMAIN, 0)
+			client.Set("/domains/other.com/value", "unknown_service", 0)
+			references, err := repository.DanglingReferences()
+
+			Convey("Then they are reported", func() {
+				So(err, ShouldBeNil)
+				So(len(references), ShouldEqual, 2)
+				So(references[0].String(), ShouldEqual, "/domains/other.com/value: other.com -> unknown_service")
+				So(references[1].String(), ShouldEqual, "/services/my_service/1/domain: mydomain.com -> my_service")
+			})
+		})
+	})
+}
+
+// A backend without transactions, on which the type of a domain is created
+// by someone else right before it is written.
+type concurrentDomainBackend struct {
+	Backend
+}
+
+func (b *concurrentDomainBackend) Create(key string, value string, ttl uint64) (*Response, error) {
+	if strings.HasSuffix(key, "/type") {
+		b.Backend.Create(key, URI_DOMAIN, 0)
+		b.Backend.Create(strings.TrimSuffix(key, "/type")+"/redirect", "true", 0)
+	}
+	return b.Backend.Create(key, value, ttl)
+}
+
+func Test_DomainRepositoryWithoutTxn(t *testing.T) {
+	Convey("Given a domain repository on a backend without transactions", t, func() {
+		client := NewMemoryBackend()
+		client.Set("/services/my_service/1/domain", "mydomain.com", 0)
+		repository := NewDomainRepository(&concurrentDomainBackend{client}, "", "")
+
+		Convey("When a domain is created concurrently", func() {
+			err := repository.CreateDomain("mydomain.com", &Domain{Typ: SERVICE_DOMAIN, Value: "my_service"})
+
+			Convey("Then a conflict is returned", func() {
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+			})
+
+			Convey("Then only the keys it wrote are removed", func() {
+				response, err := client.Get("/domains/mydomain.com", true)
+				So(err, ShouldBeNil)
+				So(len(response.Node.Nodes), ShouldEqual, 2)
+				So(response.Node.Nodes[0].Key, ShouldEqual, "/domains/mydomain.com/redirect")
+				So(response.Node.Nodes[1].Value, ShouldEqual, URI_DOMAIN)
+			})
+		})
+
+		Convey("When the value of a domain whose type changed is updated", func() {
+			client.Set("/domains/mydomain.com/type", URI_DOMAIN, 0)
+			client.Set("/domains/mydomain.com/value", "my_service", 0)
+			client.Set("/services/other_service/1/domain", "mydomain.com", 0)
+
+			err := repository.UpdateDomain("mydomain.com",
+				&Domain{Typ: SERVICE_DOMAIN, Value: "my_service"},
+				&Domain{Typ: SERVICE_DOMAIN, Value: "other_service"})
+
+			Convey("Then a conflict is returned and nothing is written", func() {
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+				response, _ := client.Get("/domains/mydomain.com/value", false)
+				So(response.Node.Value, ShouldEqual, "my_service")
+			})
+		})
+	})
+}
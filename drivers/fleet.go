@@ -16,13 +16,25 @@ import (
 
 
 
+// Number of writes of a status changed concurrently before giving up.
+const maxWriteAttempts = 3
+
 type FleetServiceDriver struct {
-	client *etcd.Client
+	client   Backend
+	endpoint string
 }
 
 
 func NewFleetServiceDriver(client *etcd.Client) *FleetServiceDriver {
-	return &FleetServiceDriver{client}
+	return &FleetServiceDriver{NewEtcdBackend(client), ""}
+}
+
+// NewFleetServiceDriverWithBackend creates a driver that stores statuses in
+// client and drives units with fleetctl against the given fleet endpoint. An
+// empty endpoint is only supported for an *EtcdBackend, whose first etcd
+// member is used.
+func NewFleetServiceDriverWithBackend(client Backend, endpoint string) *FleetServiceDriver {
+	return &FleetServiceDriver{client, endpoint}
 }
 
 func (f *FleetServiceDriver) Create(s *Service) (*Service,error) {
@@ -31,39 +43,62 @@ func (f *FleetServiceDriver) Create(s *Service) (*Service,error) {
 
 
 func (f *FleetServiceDriver) Start(s *Service) (*Service,error) {
-	err := f.fleetcmd(s, "start", f.client)
+	err := f.fleetcmd(s, "start")
 	return s,err
 }
 
 func (f *FleetServiceDriver) Stop(s *Service) (*Service,error) {
-	err := f.fleetcmd(s, "stop", f.client)
+	err := f.fleetcmd(s, "stop")
 	return s,err
 }
 
 
 func (f *FleetServiceDriver) Passivate(s *Service) (*Service,error) {
 	glog.Info(fmt.Sprintf("Passivating service %s",s.Name))
-	err := f.fleetcmd(s, "destroy", f.client)
+	err := f.fleetcmd(s, "destroy")
 	if err != nil {
 		return s,err
 	}
 
-	statusKey := s.NodeKey + "/status"
+	repository := NewServiceRepository(f.client, "")
 
-	responseCurrent, error := f.client.Set(statusKey+"/current", PASSIVATED_STATUS, 0)
-	if error != nil && responseCurrent == nil {
-		glog.Errorf("Setting status current to 'passivated' has failed for Service "+s.Name+": %s", error)
+	s, err = setStatus(repository, s, repository.SetCurrentStatus)
+	if err != nil {
+		glog.Errorf("Setting status current to 'passivated' has failed for Service "+s.Name+": %s", err)
+		return s, err
 	}
 
-	response, error := f.client.Set(statusKey+"/expected", PASSIVATED_STATUS, 0)
-	if error != nil && response == nil {
-		glog.Errorf("Setting status expected to 'passivated' has failed for Service "+s.Name+": %s", error)
+	s, err = setStatus(repository, s, repository.SetExpectedStatus)
+	if err != nil {
+		glog.Errorf("Setting status expected to 'passivated' has failed for Service "+s.Name+": %s", err)
 	}
-	return s, nil
+	return s, err
+}
+
+// Sets a status of s to passivated with set. As fleet may write the status
+// while it destroys the unit, s is read again when it has been changed.
+func setStatus(repository *ServiceRepository, s *Service, set func(*Service, string) (*Service, error)) (*Service, error) {
+	var err error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		var updated *Service
+		if updated, err = set(s, PASSIVATED_STATUS); err == nil {
+			return updated, nil
+		}
+		if _, conflict := err.(*ConflictError); !conflict {
+			return s, err
+		}
+
+		read, readErr := repository.Get(s)
+		if readErr != nil {
+			return s, readErr
+		}
+		s = read
+	}
+	return s, err
 }
 
 func (f *FleetServiceDriver) Destroy(s *Service)  error {
-	err := f.fleetcmd(s, "destroy", f.client)
+	err := f.fleetcmd(s, "destroy")
 	return err
 }
 
@@ -72,14 +107,26 @@ func  unitNameFromService(s *Service) string {
 }
 
 
-func (f *FleetServiceDriver) fleetcmd(s *Service, command string, client *etcd.Client) error {
+func (f *FleetServiceDriver) fleetcmd(s *Service, command string) error {
 	//TODO Use fleet's REST API
-	etcdAddress := client.GetCluster()[0]
+	endpoint, err := f.fleetEndpoint()
+	if err != nil {
+		return err
+	}
 
-	cmd := exec.Command("/usr/bin/fleetctl", "--endpoint="+etcdAddress, command, unitNameFromService(s))
+	cmd := exec.Command("/usr/bin/fleetctl", "--endpoint="+endpoint, command, unitNameFromService(s))
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
+func (f *FleetServiceDriver) fleetEndpoint() (string, error) {
+	if f.endpoint != "" {
+		return f.endpoint, nil
+	}
+	if backend, ok := f.client.(*EtcdBackend); ok && len(backend.Client.GetCluster()) > 0 {
+		return backend.Client.GetCluster()[0], nil
+	}
+	return "", errors.New("No fleet endpoint")
+}
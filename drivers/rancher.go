@@ -7,13 +7,19 @@ import (
 )
 
 type RancherServiceDriver struct {
-	client           *etcd.Client
+	client           Backend
 	rancherHost      string
 	rancherAccessKey string
 	rancherSecretKey string
 }
 
 func NewRancherServiceDriver(client *etcd.Client,rancherHost string,rancherAccessKey string,rancherSecretKey string) *RancherServiceDriver {
+	return NewRancherServiceDriverWithBackend(NewEtcdBackend(client), rancherHost, rancherAccessKey, rancherSecretKey)
+}
+
+// NewRancherServiceDriverWithBackend creates a driver that stores statuses in
+// client and drives the services through the given Rancher API.
+func NewRancherServiceDriverWithBackend(client Backend, rancherHost string, rancherAccessKey string, rancherSecretKey string) *RancherServiceDriver {
 	return &RancherServiceDriver{
 		client,
 		rancherHost,
@@ -0,0 +1,132 @@
+package goarken
+
+import (
+	"github.com/coreos/go-etcd/etcd"
+)
+
+const (
+	etcdKeyNotFound       = 100
+	etcdTestFailed        = 101
+	etcdNodeExist         = 105
+	etcdEventIndexCleared = 401
+)
+
+// EtcdBackend is a Backend that stores the model in etcd, through the etcd v2
+// API.
+type EtcdBackend struct {
+	Client *etcd.Client
+}
+
+func NewEtcdBackend(client *etcd.Client) *EtcdBackend {
+	return &EtcdBackend{client}
+}
+
+func (b *EtcdBackend) Get(key string, recursive bool) (*Response, error) {
+	response, err := b.Client.Get(key, true, recursive)
+	return fromEtcdResponse(response, err)
+}
+
+func (b *EtcdBackend) Set(key string, value string, ttl uint64) (*Response, error) {
+	response, err := b.Client.Set(key, value, ttl)
+	return fromEtcdResponse(response, err)
+}
+
+func (b *EtcdBackend) Create(key string, value string, ttl uint64) (*Response, error) {
+	response, err := b.Client.Create(key, value, ttl)
+	return fromEtcdResponse(response, err)
+}
+
+func (b *EtcdBackend) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error) {
+	response, err := b.Client.CompareAndSwap(key, value, ttl, prevValue, prevIndex)
+	return fromEtcdResponse(response, err)
+}
+
+func (b *EtcdBackend) Delete(key string, recursive bool) (*Response, error) {
+	response, err := b.Client.Delete(key, recursive)
+	return fromEtcdResponse(response, err)
+}
+
+func (b *EtcdBackend) Watch(prefix string, waitIndex uint64, receiver chan *Response, stop chan bool) error {
+	etcdReceiver := make(chan *etcd.Response)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer close(receiver)
+		for response := range etcdReceiver {
+			receiver <- toResponse(response)
+		}
+	}()
+
+	_, err := b.Client.Watch(prefix, waitIndex, true, etcdReceiver, stop)
+	// etcdReceiver has been closed by the client, wait for the last
+	// responses to be forwarded.
+	<-done
+	b.Client.CloseCURL()
+	return fromEtcdError(err)
+}
+
+// Close releases the connections to etcd.
+func (b *EtcdBackend) Close() error {
+	b.Client.Close()
+	return nil
+}
+
+// Endpoints returns the etcd machines the client is connected to.
+func (b *EtcdBackend) Endpoints() []string {
+	return b.Client.GetCluster()
+}
+
+func fromEtcdResponse(response *etcd.Response, err error) (*Response, error) {
+	if err != nil {
+		return nil, fromEtcdError(err)
+	}
+	return toResponse(response), nil
+}
+
+func toResponse(response *etcd.Response) *Response {
+	return &Response{
+		Action:   response.Action,
+		Node:     fromEtcdNode(response.Node),
+		PrevNode: fromEtcdNode(response.PrevNode),
+		Index:    response.EtcdIndex,
+	}
+}
+
+func fromEtcdNode(node *etcd.Node) *Node {
+	if node == nil {
+		return nil
+	}
+	result := &Node{
+		Key:           node.Key,
+		Value:         node.Value,
+		Dir:           node.Dir,
+		Expiration:    node.Expiration,
+		TTL:           node.TTL,
+		ModifiedIndex: node.ModifiedIndex,
+		CreatedIndex:  node.CreatedIndex,
+	}
+	for _, child := range node.Nodes {
+		result.Nodes = append(result.Nodes, fromEtcdNode(child))
+	}
+	return result
+}
+
+func fromEtcdError(err error) error {
+	if err == etcd.ErrWatchStoppedByUser {
+		return ErrWatchStopped
+	}
+	if etcdErr, ok := err.(*etcd.EtcdError); ok {
+		switch etcdErr.ErrorCode {
+		case etcdKeyNotFound:
+			return ErrKeyNotFound
+		case etcdTestFailed:
+			return ErrCompareFailed
+		case etcdNodeExist:
+			return ErrKeyExists
+		case etcdEventIndexCleared:
+			return ErrIndexCleared
+		}
+	}
+	return err
+}
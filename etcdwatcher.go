@@ -1,10 +1,14 @@
 package goarken
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/golang/glog"
+	"io"
+	"path"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,98 +17,548 @@ const (
 )
 
 // A Watcher loads and watch the etcd hierarchy for Domains and Services.
+// Once the Watcher is initialized, Domains and Services are updated by the
+// watch goroutines: they must be read through GetDomain, GetServiceCluster,
+// the snapshot or iteration functions.
 type Watcher struct {
-	Client        *etcd.Client
+	Client        Backend
 	DomainPrefix  string
 	ServicePrefix string
 	Domains       map[string]*Domain
 	Services      map[string]*ServiceCluster
-	broadcaster   *Broadcaster
+	// Delays between reconnections to the backend
+	Backoff Backoff
+	// Changes of a service within this window after its first change are
+	// applied together, with a single reload and broadcast. 0 disables it.
+	CoalesceWindow time.Duration
+	// Number of status changes kept per instance, DefaultHistorySize by
+	// default. A negative size disables the history.
+	HistorySize int
+	// Log of the status changes, none by default.
+	AuditLog    AuditLog
+	coalescer   *coalescer
+	broadcaster *Broadcaster
+	lock        sync.RWMutex
+
+	cancel  context.CancelFunc
+	watches sync.WaitGroup
+	// Closed once the Watcher has shut down
+	stopped chan struct{}
+
+	health       map[string]*PrefixHealth
+	synced       chan struct{}
+	syncedClosed bool
+	healthLock   sync.Mutex
+
+	history     map[string]*statusRing
+	historyLock sync.Mutex
+
+	clusterStatuses   map[string]*ClusterStatus
+	clusterStatusLock sync.Mutex
 }
 
-//Init Domains and Services.
+//Init Domains and Services. Returns once they are loaded, or their load failed.
 func (w *Watcher) Init() {
+	w.Start(context.Background())
+	if err := w.WaitForSync(context.Background()); err != nil {
+		glog.Errorf("Unable to load the domains and services: %v", err)
+	}
+}
+
+// Start loads the Domains and Services and watches their changes until ctx is
+// done or Stop is called. The Watcher then closes the channels of its
+// subscribers, stops its watches and closes its Client if it is an io.Closer.
+// Start doesn't wait for the initial load, see WaitForSync.
+func (w *Watcher) Start(ctx context.Context) {
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.stopped = make(chan struct{})
 	w.broadcaster = NewBroadcaster()
 	SetServicePrefix(w.ServicePrefix)
 	SetDomainPrefix(w.DomainPrefix)
+
+	var prefixes []string
+	if w.Domains != nil {
+		prefixes = append(prefixes, w.DomainPrefix)
+	}
+	if w.Services != nil {
+		prefixes = append(prefixes, w.ServicePrefix)
+	}
+	w.initHealth(prefixes...)
+	if w.CoalesceWindow > 0 {
+		w.coalescer = newCoalescer(w.CoalesceWindow, w.flushService)
+	}
+
+	stop := make(chan bool)
 	if w.Domains != nil {
-		w.loadPrefix(w.DomainPrefix, w.registerDomain)
-		go w.doWatch(w.DomainPrefix, w.registerDomain)
+		w.watches.Add(1)
+		go w.doWatch(ctx, stop, w.DomainPrefix, w.registerDomain)
 	}
 	if w.Services != nil {
-		w.loadPrefix(w.ServicePrefix, w.registerService)
-		go w.doWatch(w.ServicePrefix, w.registerService)
+		w.watches.Add(1)
+		go w.doWatch(ctx, stop, w.ServicePrefix, w.registerService)
 	}
 
+	go func() {
+		<-ctx.Done()
+		// Subscriptions are closed first, so that no watch stays blocked
+		// on a subscriber that does not read anymore
+		w.broadcaster.Close()
+		close(stop)
+		w.watches.Wait()
+		if w.coalescer != nil {
+			w.coalescer.stop()
+		}
+		w.releaseSync()
+
+		if closer, ok := w.Client.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				glog.Warningf("Unable to close the backend: %v", err)
+			}
+		}
+		glog.Info("Watcher stopped")
+		close(w.stopped)
+	}()
+}
+
+// Stop stops the Watcher and returns once it has shut down.
+func (w *Watcher) Stop() {
+	if w.cancel == nil {
+		return
+	}
+	w.cancel()
+	<-w.stopped
 }
 
-func (w *Watcher) Listen() chan interface{} {
+// Listen returns a channel receiving an Event for every change of the
+// Domains and Services.
+func (w *Watcher) Listen() chan *Event {
 	return w.broadcaster.Listen()
 }
 
+// CoalesceStats returns the counters of the coalesced changes, zero if
+// CoalesceWindow is not set.
+func (w *Watcher) CoalesceStats() CoalesceStats {
+	if w.coalescer == nil {
+		return CoalesceStats{}
+	}
+	return w.coalescer.getStats()
+}
+
+// ListenFiltered returns a channel receiving the events selected by filter,
+// like ServiceNames("tenant1_*").
+func (w *Watcher) ListenFiltered(filter EventFilter) chan *Event {
+	return w.broadcaster.ListenFiltered(filter)
+}
+
+// Subscribe returns a subscription to the changes of the Domains and
+// Services, delivered according to options.
+func (w *Watcher) Subscribe(options SubscriberOptions) *Subscription {
+	return w.broadcaster.Subscribe(options)
+}
+
+// ListenContext is like Listen, the channel is closed when ctx is done.
+func (w *Watcher) ListenContext(ctx context.Context) chan *Event {
+	return w.broadcaster.ListenContext(ctx)
+}
+
+// SubscribeContext is like Subscribe, the subscription is closed when ctx is
+// done.
+func (w *Watcher) SubscribeContext(ctx context.Context, options SubscriberOptions) *Subscription {
+	return w.broadcaster.SubscribeContext(ctx, options)
+}
+
+// GetDomain returns the domain with the given name, nil if unknown.
+func (w *Watcher) GetDomain(name string) *Domain {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.Domains[name]
+}
+
+// GetServiceCluster returns the service cluster with the given name, nil if
+// unknown.
+func (w *Watcher) GetServiceCluster(name string) *ServiceCluster {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.Services[name]
+}
+
+// DomainsSnapshot returns a copy of the domains map.
+func (w *Watcher) DomainsSnapshot() map[string]*Domain {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	domains := make(map[string]*Domain, len(w.Domains))
+	for name, domain := range w.Domains {
+		domains[name] = domain
+	}
+	return domains
+}
+
+// ServicesSnapshot returns a copy of the service clusters map.
+func (w *Watcher) ServicesSnapshot() map[string]*ServiceCluster {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	services := make(map[string]*ServiceCluster, len(w.Services))
+	for name, cluster := range w.Services {
+		services[name] = cluster
+	}
+	return services
+}
+
+// EachDomain calls f for every domain. It iterates over a snapshot, so f is
+// free to use the Watcher.
+func (w *Watcher) EachDomain(f func(name string, domain *Domain)) {
+	for name, domain := range w.DomainsSnapshot() {
+		f(name, domain)
+	}
+}
+
+// EachServiceCluster calls f for every service cluster. It iterates over a
+// snapshot, so f is free to use the Watcher.
+func (w *Watcher) EachServiceCluster(f func(name string, cluster *ServiceCluster)) {
+	for name, cluster := range w.ServicesSnapshot() {
+		f(name, cluster)
+	}
+}
+
 // Loads and watch an etcd directory to register objects like Domains, Services
 // etc... The register function is passed the etcd Node that has been loaded.
-func (w *Watcher) doWatch(etcdDir string, registerFunc func(*etcd.Node, string)) {
-	stop := make(chan struct{})
+// Watches start right after lastIndex, the index of the last change that has
+// been processed, so that no change is missed between two watches. When a
+// change can't be registered, the watch is stopped and the directory is
+// reloaded. Closing stop ends the watch, ctx must be done by then.
+func (w *Watcher) doWatch(ctx context.Context, stop chan bool, etcdDir string, registerFunc func(*Node, string) error) {
+	defer w.watches.Done()
+
+	// Failed attempts since the last success, for the backoff
+	attempt := 0
+
+	lastIndex, err := w.loadPrefix(etcdDir, registerFunc)
+	for err != nil {
+		glog.Errorf("Unable to load %s : %v", etcdDir, err)
+		w.setLoaded(etcdDir, err)
+		if !w.backoff(ctx, etcdDir, &attempt) {
+			return
+		}
+		lastIndex, err = w.loadPrefix(etcdDir, registerFunc)
+	}
+	w.setLoaded(etcdDir, nil)
+	attempt = 0
 
 	for {
-		glog.Infof("Start watching %s", etcdDir)
-
-		updateChannel := make(chan *etcd.Response, 10)
-		go w.watch(updateChannel, stop, etcdDir, registerFunc)
+		glog.Infof("Start watching %s from index %d", etcdDir, lastIndex+1)
+
+		updateChannel := make(chan *Response, 10)
+		processed := make(chan error, 1)
+		watchStop := make(chan bool)
+		var once sync.Once
+		stopWatch := func() { once.Do(func() { close(watchStop) }) }
+		go func() {
+			select {
+			case <-stop:
+				stopWatch()
+			case <-watchStop:
+			}
+		}()
+		go w.watch(updateChannel, processed, etcdDir, registerFunc, &lastIndex, stopWatch)
 
-		_, err := w.Client.Watch(etcdDir, (uint64)(0), true, updateChannel, nil)
+		started := time.Now()
+		startIndex := lastIndex
+		err := w.Client.Watch(etcdDir, lastIndex+1, updateChannel, watchStop)
 
 		//If we are here, this means etcd watch ended in an error
-		stop <- struct{}{}
-		w.Client.CloseCURL()
-		glog.Warningf("Error when watching %s : %v", etcdDir, err)
-		glog.Warningf("Waiting 1 second and relaunch watch")
-		time.Sleep(time.Second)
+		registerErr := <-processed
+		stopWatch()
+
+		if ctx.Err() != nil {
+			glog.Infof("Stop watching %s", etcdDir)
+			return
+		}
+
+		// The watch worked for a while before failing
+		if lastIndex > startIndex || time.Since(started) > w.Backoff.withDefaults().Max {
+			attempt = 0
+		}
+
+		reload := err == ErrIndexCleared || registerErr != nil
+		if registerErr != nil {
+			err = registerErr
+		}
+		w.setState(etcdDir, Reconnecting, err)
+		if reload {
+			// Changes have been lost, get the whole state back
+			if registerErr != nil {
+				glog.Warningf("Unable to apply the changes of %s after index %d, reloading it", etcdDir, lastIndex)
+			} else {
+				glog.Warningf("Index %d is not available anymore for %s, reloading it", lastIndex+1, etcdDir)
+			}
+			lastIndex, err = w.reloadPrefix(etcdDir, registerFunc)
+		} else {
+			glog.Warningf("Error when watching %s : %v", etcdDir, err)
+		}
+
+		// Wait for the backend to be reachable again
+		for err != nil {
+			if !w.backoff(ctx, etcdDir, &attempt) {
+				return
+			}
+			if reload {
+				lastIndex, err = w.reloadPrefix(etcdDir, registerFunc)
+			} else {
+				err = w.probe(etcdDir)
+			}
+			if err != nil {
+				w.setState(etcdDir, Failed, err)
+			}
+		}
+		w.setState(etcdDir, Connected, nil)
+
+	}
+
+}
 
+// Waits before the next attempt to reach the backend, returns false if ctx is
+// done before.
+func (w *Watcher) backoff(ctx context.Context, etcdDir string, attempt *int) bool {
+	delay := w.Backoff.Delay(*attempt)
+	*attempt++
+	glog.Warningf("Retrying %s in %v", etcdDir, delay)
+	return sleep(ctx, delay)
+}
+
+// Checks that etcDir can be read.
+func (w *Watcher) probe(etcDir string) error {
+	_, err := w.Client.Get(etcDir, false)
+	if err == ErrKeyNotFound {
+		return nil
 	}
+	return err
+}
 
+// Waits for d, returns false if ctx is done before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
 
-func (w *Watcher) loadPrefix(etcDir string, registerFunc func(*etcd.Node, string)) {
-	response, err := w.Client.Get(etcDir, true, true)
+// Registers every object found under etcDir and returns the index of the
+// backend at load time.
+func (w *Watcher) loadPrefix(etcDir string, registerFunc func(*Node, string) error) (uint64, error) {
+	response, err := w.Client.Get(etcDir, true)
 	if err == nil {
 		for _, serviceNode := range response.Node.Nodes {
-			registerFunc(serviceNode, response.Action)
-
+			if err := registerFunc(serviceNode, response.Action); err != nil {
+				return 0, err
+			}
 		}
+		return response.Index, nil
 	}
+	if err != ErrKeyNotFound {
+		return 0, err
+	}
+
+	// The directory may not exist yet, only get the current index
+	response, err = w.Client.Get("/", false)
+	if err != nil {
+		return 0, err
+	}
+	return response.Index, nil
 }
 
-func (w *Watcher) watch(updateChannel chan *etcd.Response, stop chan struct{}, key string, registerFunc func(*etcd.Node, string)) {
-	for {
-		select {
-		case <-stop:
-			glog.Warningf("Gracefully closing the etcd watch for %s", key)
-			return
-		case response := <-updateChannel:
-			if response != nil {
-				registerFunc(response.Node, response.Action)
+// Loads etcDir again and removes the objects that don't exist anymore.
+// Returns the index of the backend at load time.
+func (w *Watcher) reloadPrefix(etcDir string, registerFunc func(*Node, string) error) (uint64, error) {
+	response, err := w.Client.Get(etcDir, false)
+	if err != nil && err != ErrKeyNotFound {
+		glog.Errorf("Unable to reload %s : %v", etcDir, err)
+		return 0, err
+	}
+
+	names := make(map[string]bool)
+	if err == nil {
+		for _, node := range response.Node.Nodes {
+			names[path.Base(node.Key)] = true
+		}
+	}
+
+	var events []*Event
+	w.lock.Lock()
+	switch etcDir {
+	case w.DomainPrefix:
+		for name := range w.Domains {
+			if !names[name] {
+				events = append(events, w.deleteDomain(name, w.DomainPrefix+"/"+name, 0))
+			}
+		}
+	case w.ServicePrefix:
+		for name := range w.Services {
+			if !names[name] {
+				events = append(events, w.deleteEnv(name, w.ServicePrefix+"/"+name, 0))
 			}
-		default:
-			// Don't slam the etcd server
-			time.Sleep(time.Second)
 		}
 	}
+	w.lock.Unlock()
+	w.broadcast(events...)
+
+	return w.loadPrefix(etcDir, registerFunc)
+}
+
+// Registers the changes received on updateChannel. lastIndex is updated with
+// the index of every change once it has been processed. When a change can't be
+// registered, lastIndex is left before it, stopWatch is called and the
+// following changes are skipped. The error, if any, is sent to processed once
+// the channel has been closed by the backend.
+func (w *Watcher) watch(updateChannel chan *Response, processed chan error, key string, registerFunc func(*Node, string) error, lastIndex *uint64, stopWatch func()) {
+	var failed error
+	for response := range updateChannel {
+		if failed != nil {
+			continue
+		}
+		if err := registerFunc(response.Node, response.Action); err != nil {
+			glog.Errorf("Unable to apply the %s of %s : %v", response.Action, response.Node.Key, err)
+			failed = err
+			stopWatch()
+			continue
+		}
+		if response.Node.ModifiedIndex > *lastIndex {
+			*lastIndex = response.Node.ModifiedIndex
+		}
+	}
+	glog.Warningf("Gracefully closing the etcd watch for %s", key)
+	processed <- failed
 }
 
 func (w *Watcher) RemoveDomain(key string) {
-	delete(w.Domains, key)
+	w.removeDomain(key, w.DomainPrefix+"/"+key, 0)
+}
+
+func (w *Watcher) removeDomain(domainName string, key string, index uint64) {
+	w.lock.Lock()
+	event := w.deleteDomain(domainName, key, index)
+	w.lock.Unlock()
 
+	w.broadcast(event)
 }
 
 func (w *Watcher) RemoveEnv(serviceName string) {
+	w.removeEnv(serviceName, w.ServicePrefix+"/"+serviceName, 0)
+}
+
+func (w *Watcher) removeEnv(serviceName string, key string, index uint64) {
+	w.lock.Lock()
+	event := w.deleteEnv(serviceName, key, index)
+	w.lock.Unlock()
+
+	w.broadcast(event)
+}
+
+func (w *Watcher) removeInstance(serviceName string, instanceIndex string, key string, index uint64) {
+	w.lock.Lock()
+	event := w.deleteInstance(serviceName, instanceIndex, key, index)
+	w.lock.Unlock()
+
+	w.broadcast(event)
+}
+
+// Applies a change of a prefix itself: its deletion removes all the domains
+// or service clusters under it, other changes don't name any.
+func (w *Watcher) registerPrefix(node *Node, action string) error {
+	if action != "delete" && action != "expire" {
+		glog.Warningf("Ignoring the %s of %s", action, node.Key)
+		return nil
+	}
+
+	var events []*Event
+	w.lock.Lock()
+	switch node.Key {
+	case w.DomainPrefix:
+		for name := range w.Domains {
+			events = append(events, w.deleteDomain(name, node.Key, node.ModifiedIndex))
+		}
+	case w.ServicePrefix:
+		for name := range w.Services {
+			events = append(events, w.deleteEnv(name, node.Key, node.ModifiedIndex))
+		}
+	}
+	w.lock.Unlock()
+	w.broadcast(events...)
+	return nil
+}
+
+// The delete functions must be called with the lock held. They return the
+// event to broadcast, nil if nothing has been deleted.
+
+func (w *Watcher) deleteDomain(domainName string, key string, index uint64) *Event {
+	domain := w.Domains[domainName]
+	if domain == nil {
+		return nil
+	}
+	delete(w.Domains, domainName)
+
+	return &Event{
+		Type:       DomainRemoved,
+		Key:        key,
+		Index:      index,
+		Name:       domainName,
+		PrevDomain: domain,
+	}
+}
+
+func (w *Watcher) deleteEnv(serviceName string, key string, index uint64) *Event {
+	cluster := w.Services[serviceName]
+	if cluster == nil {
+		return nil
+	}
 	delete(w.Services, serviceName)
+
+	return &Event{
+		Type:    ServiceClusterRemoved,
+		Key:     key,
+		Index:   index,
+		Name:    serviceName,
+		Cluster: cluster,
+	}
 }
 
-func GetDomainFromPath(domainPath string, client *etcd.Client) (*Domain, error) {
+func (w *Watcher) deleteInstance(serviceName string, instanceIndex string, key string, index uint64) *Event {
+	cluster := w.Services[serviceName]
+	if cluster == nil {
+		return nil
+	}
+	service := cluster.Remove(instanceIndex)
+	if service == nil {
+		return nil
+	}
+	glog.Infof("Removed instance %s of service %s", instanceIndex, serviceName)
+
+	return &Event{
+		Type:        ServiceInstanceRemoved,
+		Key:         key,
+		Index:       index,
+		Name:        serviceName,
+		PrevService: service,
+		Cluster:     cluster,
+	}
+}
+
+// Broadcasts events, outside of the lock so that listeners can read the
+// model while they are notified.
+func (w *Watcher) broadcast(events ...*Event) {
+	for _, event := range events {
+		if event != nil {
+			w.recordStatus(event)
+			w.broadcaster.Write(event)
+			w.checkClusterStatus(event)
+		}
+	}
+}
+
+func GetDomainFromPath(domainPath string, client Backend) (*Domain, error) {
 	// Get service's root node instead of changed node.
-	response, err := client.Get(domainPath, true, true)
+	response, err := client.Get(domainPath, true)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Unable to get information for service %s from etcd", domainPath))
 	}
@@ -112,13 +566,13 @@ func GetDomainFromPath(domainPath string, client *etcd.Client) (*Domain, error)
 	return GetDomainFromNode(response.Node), nil
 }
 
-func GetDomainFromNode(node *etcd.Node) *Domain {
+func GetDomainFromNode(node *Node) *Domain {
 	return NewDomain(node)
 }
 
-func GetServiceClusterFromPath(serviceClusterPath string, client *etcd.Client) (*ServiceCluster, error) {
+func GetServiceClusterFromPath(serviceClusterPath string, client Backend) (*ServiceCluster, error) {
 	// Get service's root node instead of changed node.
-	response, err := client.Get(serviceClusterPath, true, true)
+	response, err := client.Get(serviceClusterPath, true)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Unable to get information for service %s from etcd", serviceClusterPath))
 	}
@@ -126,7 +580,7 @@ func GetServiceClusterFromPath(serviceClusterPath string, client *etcd.Client) (
 	return GetServiceClusterFromNode(response.Node), nil
 }
 
-func GetServiceClusterFromNode(clusterNode *etcd.Node) *ServiceCluster {
+func GetServiceClusterFromNode(clusterNode *Node) *ServiceCluster {
 
 	sc := NewServiceCluster(clusterNode.Key)
 	for _, indexNode := range clusterNode.Nodes {
@@ -141,73 +595,237 @@ func GetServiceClusterFromNode(clusterNode *etcd.Node) *ServiceCluster {
 
 }
 
-func (w *Watcher) registerDomain(node *etcd.Node, action string) {
+// Applies a change under the domain prefix. An error is returned when the
+// domain can't be read, the change is not applied then.
+func (w *Watcher) registerDomain(node *Node, action string) error {
+	if node.Key == w.DomainPrefix {
+		return w.registerPrefix(node, action)
+	}
 
 	domainName := getDomainForNode(node)
 
 	if action == "delete" || action == "expire" {
-		w.RemoveDomain(domainName)
-		return
+		w.removeDomain(domainName, node.Key, node.ModifiedIndex)
+		return nil
 	}
 
 	domainKey := w.DomainPrefix + "/" + domainName
-	response, err := w.Client.Get(domainKey, true, false)
+	if action != "get" && w.patchDomain(domainName, node, action) {
+		return nil
+	}
 
-	if err == nil {
-		domain := NewDomain(response.Node)
+	domainNode := node
+	if action != "get" || node.Key != domainKey {
+		// Only loads give the whole domain
+		response, err := w.Client.Get(domainKey, false)
+		if err == ErrKeyNotFound {
+			// Removed since, its deletion follows
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		domainNode = response.Node
+	}
 
-		actualDomain := w.Domains[domainName]
+	domain := NewDomain(domainNode)
 
-		if domain.Typ != "" && domain.Value != "" && !domain.Equals(actualDomain) {
-			w.Domains[domainName] = domain
-			glog.Infof("Registered domain %s with (%s) %s", domainName, domain.Typ, domain.Value)
+	w.lock.Lock()
+	actualDomain := w.Domains[domainName]
 
-			//Broadcast the updated domain
-			w.broadcaster.Write(domain)
+	var event *Event
+	if domain.Typ != "" && domain.Value != "" && !domain.Equals(actualDomain) {
+		w.Domains[domainName] = domain
+		glog.Infof("Registered domain %s with (%s) %s", domainName, domain.Typ, domain.Value)
 
+		event = &Event{
+			Type:       DomainAdded,
+			Key:        node.Key,
+			Index:      node.ModifiedIndex,
+			Name:       domainName,
+			PrevDomain: actualDomain,
+			Domain:     domain,
+		}
+		if actualDomain != nil {
+			event.Type = DomainUpdated
 		}
-
 	}
+	w.lock.Unlock()
 
+	//Broadcast the updated domain
+	w.broadcast(event)
+	return nil
 }
 
-func (w *Watcher) registerService(node *etcd.Node, action string) {
+// Applies a change under the service prefix. An error is returned when the
+// service can't be read, the change is not applied then. The coalescer retries
+// the changes it flushes instead.
+func (w *Watcher) registerService(node *Node, action string) error {
+	if node.Key == w.ServicePrefix {
+		return w.registerPrefix(node, action)
+	}
 
 	serviceName := getEnvForNode(node)
+	clusterKey := w.ServicePrefix + "/" + serviceName
 
-	if action == "delete" && node.Key == w.ServicePrefix+"/"+serviceName {
-		w.RemoveEnv(serviceName)
-		return
+	// Changes read by a load are applied right away
+	coalesce := w.coalescer != nil && action != "get"
+
+	if action == "delete" || action == "expire" {
+		if coalesce {
+			// Keep the changes in order
+			w.coalescer.flushNow(serviceName)
+		}
+		if node.Key == clusterKey {
+			w.removeEnv(serviceName, node.Key, node.ModifiedIndex)
+			return nil
+		}
+
+		index := getEnvIndexForNode(node)
+		if _, err := strconv.Atoi(index); err == nil && node.Key == clusterKey+"/"+index {
+			w.removeInstance(serviceName, index, node.Key, node.ModifiedIndex)
+			return nil
+		}
+
+		if action == "expire" {
+			// Expirations are applied right away, so that dead instances
+			// stop being routed to
+			prev := w.getInstance(serviceName, index)
+			if err := w.flushService(serviceName, []*Response{{Action: action, Node: node}}); err != nil {
+				return err
+			}
+			if prev != nil && node.Key == clusterKey+"/"+index+"/status/alive" {
+				w.instanceDead(serviceName, index, prev, node)
+			}
+			return nil
+		}
+	}
+
+	if action == "get" && node.Key == clusterKey {
+		// Loads give the whole service
+		w.updateService(serviceName, node, node)
+		return nil
 	}
 
+	if coalesce {
+		w.coalescer.add(serviceName, &Response{Action: action, Node: node})
+		return nil
+	}
+	return w.flushService(serviceName, []*Response{{Action: action, Node: node}})
+}
+
+// Returns an instance of a service cluster, nil if unknown.
+func (w *Watcher) getInstance(serviceName string, index string) *Service {
+	cluster := w.GetServiceCluster(serviceName)
+	if cluster == nil {
+		return nil
+	}
+	return cluster.Get(index)
+}
+
+// Broadcasts that the alive status of an instance has expired.
+func (w *Watcher) instanceDead(serviceName string, index string, prev *Service, node *Node) {
+	glog.Infof("Service instance %s/%s is dead", serviceName, index)
+	w.broadcast(&Event{
+		Type:        ServiceInstanceDead,
+		Key:         node.Key,
+		Index:       node.ModifiedIndex,
+		Name:        serviceName,
+		PrevService: prev,
+		Service:     w.getInstance(serviceName, index),
+		Cluster:     w.GetServiceCluster(serviceName),
+	})
+}
+
+// Applies changes of a service, directly when possible, by reading the
+// service again otherwise.
+func (w *Watcher) flushService(serviceName string, changes []*Response) error {
+	if !w.patchService(serviceName, changes) {
+		return w.reloadService(serviceName, changes[len(changes)-1].Node)
+	}
+	return nil
+}
+
+// Loads a service cluster from the backend and broadcasts what changed. node
+// is the last changed node.
+func (w *Watcher) reloadService(serviceName string, node *Node) error {
+	clusterKey := w.ServicePrefix + "/" + serviceName
+
 	// Get service's root node instead of changed node.
-	response, err := w.Client.Get(w.ServicePrefix+"/"+serviceName, true, true)
+	response, err := w.Client.Get(clusterKey, true)
 
-	if err == nil {
+	if err == ErrKeyNotFound {
+		// Backends without directories only notify the removal of each key
+		w.removeEnv(serviceName, node.Key, node.ModifiedIndex)
+		return nil
+	}
 
-		sc := GetServiceClusterFromNode(response.Node)
+	if err != nil {
+		glog.Errorf("Unable to get information for service %s from etcd", serviceName)
+		return err
+	}
 
-		if w.Services[sc.Name] == nil {
-			w.Services[sc.Name] = sc
-			w.broadcaster.Write(w.Services[serviceName])
+	w.updateService(serviceName, response.Node, node)
+	return nil
+}
 
-		} else {
-			for _, service := range sc.GetInstances() {
-				actualEnv := w.Services[serviceName].Get(service.Index)
-				if !actualEnv.Equals(service) {
-					w.Services[serviceName].Add(service)
-					if service.Location.Host != "" && service.Location.Port != 0 {
-						glog.Infof("Registering service %s with location : http://%s:%d/", serviceName, service.Location.Host, service.Location.Port)
-					} else {
-						glog.Infof("Registering service %s without location", serviceName)
-					}
-					//Broadcast the updated object
-					w.broadcaster.Write(w.Services[serviceName])
+// Replaces the instances of a service cluster by the ones read from
+// clusterNode and broadcasts what changed. node is the last changed node.
+func (w *Watcher) updateService(serviceName string, clusterNode *Node, node *Node) {
+	sc := GetServiceClusterFromNode(clusterNode)
+	var events []*Event
+
+	w.lock.Lock()
+	if w.Services[sc.Name] == nil {
+		w.Services[sc.Name] = sc
+		for _, service := range sc.GetInstances() {
+			events = append(events, &Event{
+				Type:    ServiceInstanceAdded,
+				Key:     node.Key,
+				Index:   node.ModifiedIndex,
+				Name:    serviceName,
+				Service: service,
+				Cluster: sc,
+			})
+		}
+
+	} else {
+		cluster := w.Services[serviceName]
+		for _, service := range sc.GetInstances() {
+			actualEnv := cluster.Get(service.Index)
+			if !actualEnv.Equals(service) {
+				cluster.Add(service)
+				if service.Location.Host != "" && service.Location.Port != 0 {
+					glog.Infof("Registering service %s with location : http://%s:%d/", serviceName, service.Location.Host, service.Location.Port)
+				} else {
+					glog.Infof("Registering service %s without location", serviceName)
+				}
+
+				event := &Event{
+					Type:        ServiceInstanceAdded,
+					Key:         node.Key,
+					Index:       node.ModifiedIndex,
+					Name:        serviceName,
+					PrevService: actualEnv,
+					Service:     service,
+					Cluster:     cluster,
+				}
+				if actualEnv != nil {
+					event.Type = ServiceInstanceUpdated
 				}
+				events = append(events, event)
 			}
 		}
 
-	} else {
-		glog.Errorf("Unable to get information for service %s from etcd", serviceName)
+		// Instances that are not in etcd anymore
+		for _, service := range cluster.GetInstances() {
+			if sc.Get(service.Index) == nil {
+				events = append(events, w.deleteInstance(serviceName, service.Index, node.Key, node.ModifiedIndex))
+			}
+		}
 	}
+	w.lock.Unlock()
+
+	//Broadcast the updated objects
+	w.broadcast(events...)
 }
@@ -1,11 +1,14 @@
 package goarken
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/coreos/go-etcd/etcd"
 	. "github.com/smartystreets/goconvey/convey"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -16,6 +19,300 @@ func Test_EtcdWatcher(t *testing.T) {
 	}
 }
 
+func Test_MemoryWatcher(t *testing.T) {
+	testWatcher(t, NewMemoryBackend())
+}
+
+func Test_WatcherReload(t *testing.T) {
+	var w *Watcher
+	var client *MemoryBackend
+
+	Convey("Given a Watcher that missed some changes", t, func() {
+		client = NewMemoryBackend()
+		client.Set("/domains/new.com/type", "service", 0)
+		client.Set("/domains/new.com/value", "my_service", 0)
+
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Domains: map[string]*Domain{
+				"old.com": &Domain{Typ: "service", Value: "old_service"},
+			},
+		}
+		SetDomainPrefix(w.DomainPrefix)
+		w.broadcaster = NewBroadcaster()
+
+		Convey("When the domains are reloaded", func() {
+			index, err := w.reloadPrefix(w.DomainPrefix, w.registerDomain)
+			So(err, ShouldBeNil)
+
+			Convey("Then the removed domains are gone", func() {
+				So(w.GetDomain("old.com"), ShouldBeNil)
+			})
+
+			Convey("Then the new domains are registered", func() {
+				So(w.GetDomain("new.com").Value, ShouldEqual, "my_service")
+			})
+
+			Convey("Then the watch can start after the reload", func() {
+				So(index, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func Test_WatcherKeyRemoval(t *testing.T) {
+	var w *Watcher
+
+	Convey("Given a Watcher on a backend without directories", t, func() {
+		cluster := NewServiceCluster("my_service")
+		cluster.Add(getService("1", "my_service", true))
+
+		w = &Watcher{
+			Client:        NewMemoryBackend(),
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Services:      map[string]*ServiceCluster{"my_service": cluster},
+		}
+		SetServicePrefix(w.ServicePrefix)
+		w.broadcaster = NewBroadcaster()
+		updateChan := w.Listen()
+
+		Convey("When the last key of a service is removed", func() {
+			go w.registerService(&Node{Key: "/services/my_service/1/domain", ModifiedIndex: 12}, "delete")
+			event, _ := wait(updateChan)
+
+			Convey("Then the whole cluster removal is broadcast", func() {
+				So(event.Type, ShouldEqual, ServiceClusterRemoved)
+				So(event.Index, ShouldEqual, 12)
+				So(event.Cluster, ShouldEqual, cluster)
+				So(w.GetServiceCluster("my_service"), ShouldBeNil)
+			})
+		})
+
+		Convey("When the prefix itself is removed", func() {
+			w.Domains = map[string]*Domain{"mydomain.com": {Typ: SERVICE_DOMAIN, Value: "my_service"}}
+			go func() {
+				w.registerService(&Node{Key: "/services", Dir: true, ModifiedIndex: 13}, "delete")
+				w.registerDomain(&Node{Key: "/domains", Dir: true, ModifiedIndex: 14}, "delete")
+			}()
+			clusterEvent, _ := wait(updateChan)
+			domainEvent, _ := wait(updateChan)
+
+			Convey("Then everything under it is removed", func() {
+				So(clusterEvent.Type, ShouldEqual, ServiceClusterRemoved)
+				So(clusterEvent.Index, ShouldEqual, 13)
+				So(w.GetServiceCluster("my_service"), ShouldBeNil)
+				So(domainEvent.Type, ShouldEqual, DomainRemoved)
+				So(w.GetDomain("mydomain.com"), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func Test_WatcherConcurrentAccess(t *testing.T) {
+	var w *Watcher
+	var client *MemoryBackend
+
+	Convey("Given a Watcher receiving changes", t, func() {
+		client = NewMemoryBackend()
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Domains:       make(map[string]*Domain),
+			Services:      make(map[string]*ServiceCluster),
+		}
+		w.Init()
+
+		Reset(func() {
+			w.Stop()
+		})
+
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				index := strconv.Itoa(i % 5)
+				client.Set("/domains/mydomain"+index+".com/type", "service", 0)
+				client.Set("/domains/mydomain"+index+".com/value", "my_service", 0)
+				client.Set("/services/my_service/"+index+"/domain", "mydomain"+index+".com", 0)
+				if i%10 == 0 {
+					client.Delete("/services/my_service/"+index, true)
+				}
+			}
+		}()
+
+		Convey("When the model is read at the same time", func() {
+			reads := 0
+			for running := true; running; reads++ {
+				select {
+				case <-done:
+					running = false
+				default:
+				}
+				w.EachDomain(func(name string, domain *Domain) {
+					_ = domain.Value
+				})
+				w.EachServiceCluster(func(name string, cluster *ServiceCluster) {
+					cluster.Next()
+					for _, service := range cluster.GetInstances() {
+						_ = service.Index
+					}
+				})
+				w.GetServiceCluster("my_service").Next()
+			}
+
+			Convey("Then the reads don't race with the watch", func() {
+				So(reads, ShouldBeGreaterThan, 0)
+			})
+		})
+	})
+}
+
+func Test_WatcherStop(t *testing.T) {
+	var w *Watcher
+	var client *MemoryBackend
+
+	Convey("Given a started Watcher", t, func() {
+		client = NewMemoryBackend()
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Domains:       make(map[string]*Domain),
+			Services:      make(map[string]*ServiceCluster),
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		w.Start(ctx)
+		updateChan := w.Listen()
+
+		Convey("When it is stopped", func() {
+			w.Stop()
+			w.Stop()
+
+			Convey("Then its watches are stopped", func() {
+				client.lock.Lock()
+				So(len(client.watchers), ShouldEqual, 0)
+				client.lock.Unlock()
+			})
+
+			Convey("Then the channels of its subscribers are closed", func() {
+				_, ok := <-updateChan
+				So(ok, ShouldBeFalse)
+				_, ok = <-w.Listen()
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When its subscribers stop reading", func() {
+			w.Subscribe(SubscriberOptions{BufferSize: 1, Policy: BlockWithTimeout, Timeout: time.Minute})
+			for i := 0; i < 600; i++ {
+				client.Set("/domains/domain"+strconv.Itoa(i)+".com/type", "service", 0)
+				client.Set("/domains/domain"+strconv.Itoa(i)+".com/value", "my_service", 0)
+			}
+			// Let the watch block on the subscriber
+			time.Sleep(100 * time.Millisecond)
+
+			Convey("Then it still stops", func() {
+				stopped := make(chan bool)
+				go func() {
+					w.Stop()
+					close(stopped)
+				}()
+				select {
+				case <-stopped:
+				case <-time.After(3 * time.Second):
+					So("timeout", ShouldEqual, "stopped")
+				}
+			})
+		})
+
+		Convey("When its context is cancelled", func() {
+			cancel()
+
+			Convey("Then the channels of its subscribers are closed", func() {
+				select {
+				case _, ok := <-updateChan:
+					So(ok, ShouldBeFalse)
+				case <-time.After(5 * time.Second):
+					So("timeout", ShouldEqual, "closed")
+				}
+				w.Stop()
+			})
+		})
+	})
+}
+
+func Test_WatcherRegisterFailure(t *testing.T) {
+	var w *Watcher
+	var client *failingGetBackend
+
+	Convey("Given a started Watcher", t, func() {
+		client = &failingGetBackend{MemoryBackend: NewMemoryBackend()}
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Domains:       make(map[string]*Domain),
+			Services:      make(map[string]*ServiceCluster),
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+		So(w.WaitForSync(context.Background()), ShouldBeNil)
+		updateChan := w.ListenFiltered(EventTypes(ServiceInstanceAdded, ServiceInstanceUpdated))
+
+		Convey("When a changed service can't be read", func() {
+			client.failGet("/services/my_service")
+			client.Set("/services/my_service/1/domain", "mydomain.com", 0)
+
+			Convey("Then the change is applied by a reload", func() {
+				event, err := waitFor(updateChan, 5*time.Second)
+				So(err, ShouldBeNil)
+				So(event.Type, ShouldEqual, ServiceInstanceAdded)
+				So(w.GetServiceCluster("my_service").Get("1").Domain, ShouldEqual, "mydomain.com")
+			})
+
+			Convey("Then the following changes are applied", func() {
+				waitFor(updateChan, 5*time.Second)
+				client.Set("/services/my_service/1/location", `{"host":"127.0.0.1","port":8080}`, 0)
+				event, err := waitFor(updateChan, 5*time.Second)
+				So(err, ShouldBeNil)
+				So(event.Service.Location.Port, ShouldEqual, 8080)
+			})
+		})
+	})
+}
+
+// A backend whose reads of a key fail once.
+type failingGetBackend struct {
+	*MemoryBackend
+	lock    sync.Mutex
+	failing map[string]bool
+}
+
+func (b *failingGetBackend) failGet(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failing == nil {
+		b.failing = make(map[string]bool)
+	}
+	b.failing[key] = true
+}
+
+func (b *failingGetBackend) Get(key string, recursive bool) (*Response, error) {
+	b.lock.Lock()
+	failing := b.failing[key]
+	delete(b.failing, key)
+	b.lock.Unlock()
+
+	if failing {
+		return nil, errors.New("unreachable")
+	}
+	return b.MemoryBackend.Get(key, recursive)
+}
+
 func IT_EtcdWatcher(t *testing.T) {
 
 	client := etcd.NewClient([]string{})
@@ -23,8 +320,13 @@ func IT_EtcdWatcher(t *testing.T) {
 	client.Delete("/domains", true)
 	client.Delete("/services", true)
 
+	testWatcher(t, NewEtcdBackend(client))
+}
+
+func testWatcher(t *testing.T, client Backend) {
+
 	var w *Watcher
-	var updateChan chan interface{}
+	var updateChan chan *Event
 
 	Convey("Given a Watcher", t, func() {
 		domains := make(map[string]*Domain)
@@ -41,14 +343,18 @@ func IT_EtcdWatcher(t *testing.T) {
 		w.Init()
 		updateChan = w.Listen()
 
+		Reset(func() {
+			w.Stop()
+		})
+
 		Convey("When it is started", func() {
 
 			Convey("It doesn't contains any domain", func() {
-				So(len(w.Domains), ShouldEqual, 0)
+				So(len(w.DomainsSnapshot()), ShouldEqual, 0)
 			})
 
 			Convey("It doesn't contains any service", func() {
-				So(len(w.Services), ShouldEqual, 0)
+				So(len(w.ServicesSnapshot()), ShouldEqual, 0)
 			})
 		})
 
@@ -59,24 +365,21 @@ func IT_EtcdWatcher(t *testing.T) {
 				panic(err)
 			}
 
-			So(len(w.Domains), ShouldEqual, 0)
+			So(len(w.DomainsSnapshot()), ShouldEqual, 0)
 			_, err = client.Set("/domains/mydomain.com/value", "my_service", 0)
 
-			serviceOrDomain, err := wait(updateChan)
-			So(serviceOrDomain, ShouldNotBeNil)
-
-			if d, ok := serviceOrDomain.(*Domain); ok {
-				So(d.Typ, ShouldEqual, "service")
-				So(d.Value, ShouldEqual, "my_service")
-			} else {
-				So("tot", ShouldEqual, "error")
-			}
+			event, err := wait(updateChan)
+			So(event, ShouldNotBeNil)
+			So(event.Type, ShouldEqual, DomainAdded)
+			So(event.Key, ShouldStartWith, "/domains/mydomain.com/")
+			So(event.Domain.Typ, ShouldEqual, "service")
+			So(event.Domain.Value, ShouldEqual, "my_service")
 
 			if err != nil {
 				panic(err)
 			}
-			So(len(w.Domains), ShouldEqual, 1)
-			domain := w.Domains["mydomain.com"]
+			So(len(w.DomainsSnapshot()), ShouldEqual, 1)
+			domain := w.GetDomain("mydomain.com")
 			So(domain.Typ, ShouldEqual, "service")
 			So(domain.Value, ShouldEqual, "my_service")
 
@@ -87,9 +390,11 @@ func IT_EtcdWatcher(t *testing.T) {
 			if err != nil {
 				panic(err)
 			}
-			wait(updateChan)
+			event, _ := wait(updateChan)
 			Convey("Then the domain is removed from the list of domains", func() {
-				So(len(w.Domains), ShouldEqual, 0)
+				So(len(w.DomainsSnapshot()), ShouldEqual, 0)
+				So(event.Type, ShouldEqual, DomainRemoved)
+				So(event.PrevDomain.Value, ShouldEqual, "my_service")
 
 			})
 
@@ -97,10 +402,16 @@ func IT_EtcdWatcher(t *testing.T) {
 
 		Convey("When I add a service", func() {
 			client.Set("/services/my_service/1/domain", "mydomain.com", 0)
-			wait(updateChan)
+			event, _ := wait(updateChan)
+
+			Convey("Then a new instance is broadcast", func() {
+				So(event.Type, ShouldEqual, ServiceInstanceAdded)
+				So(event.Name, ShouldEqual, "my_service")
+				So(event.Service.Domain, ShouldEqual, "mydomain.com")
+			})
 
 			Convey("Then the status should be nil", func() {
-				_, err := w.Services["my_service"].Next()
+				_, err := w.GetServiceCluster("my_service").Next()
 				So(err, ShouldNotBeNil)
 				So(err.(StatusError).Status, ShouldBeNil)
 
@@ -113,10 +424,16 @@ func IT_EtcdWatcher(t *testing.T) {
 
 			b, _ := json.Marshal(&Location{Host: "127.0.0.1", Port: 8080})
 			client.Set("/services/my_service/1/location", string(b[:]), 0)
-			wait(updateChan)
+			event, _ := wait(updateChan)
+
+			Convey("Then the instance update is broadcast", func() {
+				So(event.Type, ShouldEqual, ServiceInstanceUpdated)
+				So(event.PrevService.Location.Host, ShouldEqual, "")
+				So(event.Service.Location.Host, ShouldEqual, "127.0.0.1")
+			})
 
 			Convey("Then it should be in n/a error", func() {
-				_, err := w.Services["my_service"].Next()
+				_, err := w.GetServiceCluster("my_service").Next()
 				So(err, ShouldNotBeNil)
 				So(err.Error(), ShouldEqual, NA_STATUS)
 			})
@@ -130,7 +447,7 @@ func IT_EtcdWatcher(t *testing.T) {
 			wait(updateChan)
 
 			Convey("Then it should be stopped", func() {
-				_, err := w.Services["my_service"].Next()
+				_, err := w.GetServiceCluster("my_service").Next()
 				So(err, ShouldNotBeNil)
 				So(err.(StatusError).ComputedStatus, ShouldEqual, STOPPED_STATUS)
 			})
@@ -141,7 +458,7 @@ func IT_EtcdWatcher(t *testing.T) {
 			client.Set("/services/my_service/1/status/expected", "started", 0)
 			wait(updateChan)
 			Convey("Then the service should be in error (meaning unit has not set starting as current status)", func() {
-				_, err := w.Services["my_service"].Next()
+				_, err := w.GetServiceCluster("my_service").Next()
 				So(err, ShouldNotBeNil)
 				So(err.(StatusError).ComputedStatus, ShouldEqual, ERROR_STATUS)
 			})
@@ -151,7 +468,7 @@ func IT_EtcdWatcher(t *testing.T) {
 			client.Set("/services/my_service/1/status/current", "starting", 0)
 			wait(updateChan)
 			Convey("Then the service should be in starting", func() {
-				_, err := w.Services["my_service"].Next()
+				_, err := w.GetServiceCluster("my_service").Next()
 				So(err, ShouldNotBeNil)
 				So(err.(StatusError).ComputedStatus, ShouldEqual, STARTING_STATUS)
 			})
@@ -161,7 +478,7 @@ func IT_EtcdWatcher(t *testing.T) {
 			client.Set("/services/my_service/1/status/current", "started", 0)
 			wait(updateChan)
 			Convey("Then the service should be in error (if not alive it should be in error)", func() {
-				_, err := w.Services["my_service"].Next()
+				_, err := w.GetServiceCluster("my_service").Next()
 				So(err, ShouldNotBeNil)
 				So(err.(StatusError).ComputedStatus, ShouldEqual, ERROR_STATUS)
 			})
@@ -172,7 +489,7 @@ func IT_EtcdWatcher(t *testing.T) {
 			client.Set("/services/my_service/1/status/alive", "1", 0)
 			wait(updateChan)
 			Convey("Then the service should be starting", func() {
-				service, err := w.Services["my_service"].Next()
+				service, err := w.GetServiceCluster("my_service").Next()
 				So(err, ShouldBeNil)
 				So(service.Status.Compute(), ShouldEqual, STARTED_STATUS)
 			})
@@ -183,20 +500,42 @@ func IT_EtcdWatcher(t *testing.T) {
 			client.Set("/services/my_service/1/status/expected", PASSIVATED_STATUS, 0)
 			wait(updateChan)
 			Convey("Then the service should be starting", func() {
-				_, err := w.Services["my_service"].Next()
+				_, err := w.GetServiceCluster("my_service").Next()
 				So(err, ShouldNotBeNil)
 				So(err.(StatusError).ComputedStatus, ShouldEqual, PASSIVATED_STATUS)
 			})
 		})
 
+		Convey("When I add a second instance", func() {
+			client.Set("/services/my_service/2/domain", "mydomain.com", 0)
+			event, _ := wait(updateChan)
+
+			Convey("Then the service has two instances", func() {
+				So(event.Type, ShouldEqual, ServiceInstanceAdded)
+				So(len(w.GetServiceCluster("my_service").GetInstances()), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When I remove the second instance", func() {
+			client.Delete("/services/my_service/2", true)
+			event, _ := wait(updateChan)
+
+			Convey("Then the instance removal is broadcast", func() {
+				So(event.Type, ShouldEqual, ServiceInstanceRemoved)
+				So(event.PrevService.Index, ShouldEqual, "2")
+				So(len(w.GetServiceCluster("my_service").GetInstances()), ShouldEqual, 1)
+			})
+		})
+
 		Convey("When I remove the service", func() {
 			_, err := client.Delete("/services/my_service", true)
 			if err != nil {
 				panic(err)
 			}
-			waitFor(updateChan, time.Duration(3)*time.Second)
+			event, _ := waitFor(updateChan, time.Duration(3)*time.Second)
 			Convey("Then the domain is removed from the list of domains", func() {
-				So(len(w.Services), ShouldEqual, 0)
+				So(len(w.ServicesSnapshot()), ShouldEqual, 0)
+				So(event.Type, ShouldEqual, ServiceClusterRemoved)
 
 			})
 
@@ -206,7 +545,7 @@ func IT_EtcdWatcher(t *testing.T) {
 
 }
 
-func waitFor(iChannel chan interface{}, timeout time.Duration) (interface{}, error) {
+func waitFor(iChannel chan *Event, timeout time.Duration) (*Event, error) {
 
 	ticker := time.NewTicker(timeout)
 	for {
@@ -219,6 +558,6 @@ func waitFor(iChannel chan interface{}, timeout time.Duration) (interface{}, err
 	}
 }
 
-func wait(iChannel chan interface{}) (interface{}, error) {
+func wait(iChannel chan *Event) (*Event, error) {
 	return waitFor(iChannel, time.Duration(5)*time.Second)
 }
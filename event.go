@@ -0,0 +1,76 @@
+package goarken
+
+import "strconv"
+
+// EventType tells what kind of change an Event describes.
+type EventType int
+
+const (
+	DomainAdded EventType = iota
+	DomainUpdated
+	DomainRemoved
+	ServiceInstanceAdded
+	ServiceInstanceUpdated
+	ServiceInstanceRemoved
+	ServiceClusterRemoved
+	// The alive status of a service instance has expired
+	ServiceInstanceDead
+	// The aggregated status of a service cluster has changed
+	ServiceClusterStatusChanged
+)
+
+var eventTypeNames = map[EventType]string{
+	DomainAdded:                 "DomainAdded",
+	DomainUpdated:               "DomainUpdated",
+	DomainRemoved:               "DomainRemoved",
+	ServiceInstanceAdded:        "ServiceInstanceAdded",
+	ServiceInstanceUpdated:      "ServiceInstanceUpdated",
+	ServiceInstanceRemoved:      "ServiceInstanceRemoved",
+	ServiceClusterRemoved:       "ServiceClusterRemoved",
+	ServiceInstanceDead:         "ServiceInstanceDead",
+	ServiceClusterStatusChanged: "ServiceClusterStatusChanged",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// An Event describes a change of the model detected by a Watcher.
+type Event struct {
+	Type EventType
+	// Key on which the change has been detected
+	Key string
+	// Modified index of the key, 0 if the change has not been read from the
+	// backend.
+	Index uint64
+	// Name of the domain or of the service cluster
+	Name string
+
+	// Domain before and after the change, for domain events.
+	PrevDomain *Domain
+	Domain     *Domain
+
+	// Service instance before and after the change, and the cluster it
+	// belongs to, for service events.
+	PrevService *Service
+	Service     *Service
+	Cluster     *ServiceCluster
+
+	// Aggregated status of the cluster before and after the change, for
+	// ServiceClusterStatusChanged events.
+	PrevClusterStatus *ClusterStatus
+	ClusterStatus     *ClusterStatus
+}
+
+// IsServiceEvent tells if the event is about a service cluster or one of its
+// instances, as opposed to a domain.
+func (e *Event) IsServiceEvent() bool {
+	switch e.Type {
+	case ServiceInstanceAdded, ServiceInstanceUpdated, ServiceInstanceRemoved, ServiceClusterRemoved, ServiceInstanceDead, ServiceClusterStatusChanged:
+		return true
+	}
+	return false
+}
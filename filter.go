@@ -0,0 +1,102 @@
+package goarken
+
+import (
+	"path"
+)
+
+// An EventFilter selects the events delivered to a subscriber. Events are
+// filtered before being queued, so rejected events are not counted as dropped.
+type EventFilter func(*Event) bool
+
+// EventTypes selects the events of the given types.
+func EventTypes(types ...EventType) EventFilter {
+	return func(event *Event) bool {
+		for _, typ := range types {
+			if event.Type == typ {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ServiceNames selects the service events whose service name matches a glob
+// pattern, like "my_service" or "tenant1_*" (see path.Match).
+func ServiceNames(pattern string) EventFilter {
+	return func(event *Event) bool {
+		if !event.IsServiceEvent() {
+			return false
+		}
+		matched, err := path.Match(pattern, event.Name)
+		return err == nil && matched
+	}
+}
+
+// DomainName selects the events of a domain and the service events of the
+// instances serving it. Cluster events, which have no instance, are selected
+// if one of the instances of the cluster serves the domain.
+func DomainName(name string) EventFilter {
+	return func(event *Event) bool {
+		if !event.IsServiceEvent() {
+			return event.Name == name
+		}
+		services := []*Service{event.PrevService, event.Service}
+		if event.PrevService == nil && event.Service == nil && event.Cluster != nil {
+			services = event.Cluster.GetInstances()
+		}
+		for _, service := range services {
+			if service != nil && service.Domain == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// StatusTransition selects the service events where the computed status of
+// the instance changes from one status to another. An empty status matches
+// any status. Instances that are added or removed have the n/a status on the
+// missing side.
+func StatusTransition(from string, to string) EventFilter {
+	return func(event *Event) bool {
+		if !event.IsServiceEvent() {
+			return false
+		}
+		prev := computedStatus(event.PrevService)
+		next := computedStatus(event.Service)
+		return prev != next &&
+			(from == "" || from == prev) &&
+			(to == "" || to == next)
+	}
+}
+
+// AllOf selects the events selected by every filter.
+func AllOf(filters ...EventFilter) EventFilter {
+	return func(event *Event) bool {
+		for _, filter := range filters {
+			if !filter(event) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyOf selects the events selected by at least one filter.
+func AnyOf(filters ...EventFilter) EventFilter {
+	return func(event *Event) bool {
+		for _, filter := range filters {
+			if filter(event) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func computedStatus(service *Service) string {
+	if service == nil {
+		return NA_STATUS
+	}
+	return service.Status.Compute()
+}
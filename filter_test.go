@@ -0,0 +1,74 @@
+package goarken
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func Test_EventFilters(t *testing.T) {
+
+	Convey("Given domain and service events", t, func() {
+		domainAdded := &Event{Type: DomainAdded, Name: "mydomain.com", Domain: &Domain{Typ: "service", Value: "tenant1_web"}}
+
+		failed := getService("1", "tenant1_web", false)
+		failed.Domain = "mydomain.com"
+		started := getService("1", "tenant1_web", true)
+		started.Domain = "mydomain.com"
+		instanceStarted := &Event{Type: ServiceInstanceUpdated, Name: "tenant1_web", PrevService: failed, Service: started}
+		instanceAdded := &Event{Type: ServiceInstanceAdded, Name: "tenant2_web", Service: getService("1", "tenant2_web", true)}
+
+		cluster := NewServiceCluster("tenant1_web")
+		cluster.Add(started)
+		clusterRemoved := &Event{Type: ServiceClusterRemoved, Name: "tenant1_web", Cluster: cluster}
+		clusterChanged := &Event{Type: ServiceClusterStatusChanged, Name: "tenant1_web", Cluster: cluster}
+
+		Convey("Then they can be selected by type", func() {
+			filter := EventTypes(DomainAdded, DomainRemoved)
+			So(filter(domainAdded), ShouldBeTrue)
+			So(filter(instanceStarted), ShouldBeFalse)
+		})
+
+		Convey("Then they can be selected by service name", func() {
+			filter := ServiceNames("tenant1_*")
+			So(filter(instanceStarted), ShouldBeTrue)
+			So(filter(instanceAdded), ShouldBeFalse)
+			So(filter(domainAdded), ShouldBeFalse)
+		})
+
+		Convey("Then they can be selected by domain", func() {
+			filter := DomainName("mydomain.com")
+			So(filter(domainAdded), ShouldBeTrue)
+			So(filter(instanceStarted), ShouldBeTrue)
+			So(filter(instanceAdded), ShouldBeFalse)
+			So(filter(clusterRemoved), ShouldBeTrue)
+			So(filter(clusterChanged), ShouldBeTrue)
+			So(DomainName("other.com")(clusterChanged), ShouldBeFalse)
+		})
+
+		Convey("Then they can be selected by status transition", func() {
+			So(StatusTransition(ERROR_STATUS, STARTED_STATUS)(instanceStarted), ShouldBeTrue)
+			So(StatusTransition("", STARTED_STATUS)(instanceAdded), ShouldBeTrue)
+			So(StatusTransition(STARTED_STATUS, "")(instanceStarted), ShouldBeFalse)
+			So(StatusTransition("", "")(domainAdded), ShouldBeFalse)
+		})
+
+		Convey("Then filters can be combined", func() {
+			So(AllOf(ServiceNames("tenant*"), EventTypes(ServiceInstanceAdded))(instanceAdded), ShouldBeTrue)
+			So(AllOf(ServiceNames("tenant*"), EventTypes(ServiceInstanceAdded))(instanceStarted), ShouldBeFalse)
+			So(AnyOf(DomainName("mydomain.com"), ServiceNames("tenant2_*"))(instanceAdded), ShouldBeTrue)
+		})
+
+		Convey("When a filtered subscriber receives them", func() {
+			b := NewBroadcaster()
+			subscription := b.Subscribe(SubscriberOptions{BufferSize: 1, Filter: ServiceNames("tenant1_*")})
+			b.Write(domainAdded)
+			b.Write(instanceAdded)
+			b.Write(instanceStarted)
+
+			Convey("Then only the selected events are queued", func() {
+				So(<-subscription.C, ShouldEqual, instanceStarted)
+				So(subscription.Dropped(), ShouldEqual, 0)
+			})
+		})
+	})
+}
@@ -0,0 +1,168 @@
+package goarken
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrWatcherStopped = errors.New("Watcher stopped")
+
+// PrefixState is the state of the watch of a prefix.
+type PrefixState int
+
+const (
+	// The prefix has not been loaded yet.
+	Connecting PrefixState = iota
+	// The prefix is loaded and watched.
+	Connected
+	// The watch ended in an error and is about to be resumed.
+	Reconnecting
+	// The backend can't be reached, the Watcher keeps retrying.
+	Failed
+)
+
+var prefixStateNames = map[PrefixState]string{
+	Connecting:   "connecting",
+	Connected:    "connected",
+	Reconnecting: "reconnecting",
+	Failed:       "failed",
+}
+
+func (s PrefixState) String() string {
+	return prefixStateNames[s]
+}
+
+// PrefixHealth describes the watch of a prefix.
+type PrefixHealth struct {
+	State PrefixState
+	// Tells if the prefix has been fully loaded once.
+	Loaded bool
+	// Last error met, nil once connected again.
+	LastError error
+	// Time of the last state change.
+	Since time.Time
+}
+
+// WaitForSync waits until the Domains and Services are loaded in memory. It
+// returns the load error, if any, as soon as a load fails: the Watcher keeps
+// retrying in the background, Ready tells when it eventually succeeds.
+func (w *Watcher) WaitForSync(ctx context.Context) error {
+	select {
+	case <-w.synced:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	loaded, err := w.Ready()
+	if !loaded && err == nil {
+		return ErrWatcherStopped
+	}
+	return err
+}
+
+// Ready tells if every prefix has been loaded. Otherwise, it returns the
+// error that prevented a prefix to be loaded, nil while loading.
+func (w *Watcher) Ready() (bool, error) {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+
+	loaded := true
+	for _, health := range w.health {
+		if !health.Loaded {
+			loaded = false
+			if health.LastError != nil {
+				return false, health.LastError
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// Health returns the state of the watch of each prefix.
+func (w *Watcher) Health() map[string]PrefixHealth {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+
+	health := make(map[string]PrefixHealth, len(w.health))
+	for prefix, h := range w.health {
+		health[prefix] = *h
+	}
+	return health
+}
+
+func (w *Watcher) initHealth(prefixes ...string) {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+
+	w.health = make(map[string]*PrefixHealth)
+	w.synced = make(chan struct{})
+	w.syncedClosed = false
+	for _, prefix := range prefixes {
+		w.health[prefix] = &PrefixHealth{State: Connecting, Since: time.Now()}
+	}
+	w.checkSynced()
+}
+
+// Records the result of the load of a prefix.
+func (w *Watcher) setLoaded(prefix string, err error) {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+
+	health := w.health[prefix]
+	if err == nil {
+		health.Loaded = true
+		health.update(Connected, nil)
+	} else {
+		health.update(Failed, err)
+	}
+	w.checkSynced()
+}
+
+func (w *Watcher) setState(prefix string, state PrefixState, err error) {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+
+	w.health[prefix].update(state, err)
+}
+
+// Releases WaitForSync once every prefix is loaded or a load failed. Must be
+// called with the health lock held.
+func (w *Watcher) checkSynced() {
+	if w.syncedClosed {
+		return
+	}
+	synced := true
+	for _, health := range w.health {
+		if !health.Loaded && health.LastError != nil {
+			synced = true
+			break
+		}
+		if !health.Loaded {
+			synced = false
+		}
+	}
+	if synced {
+		w.syncedClosed = true
+		close(w.synced)
+	}
+}
+
+// Releases WaitForSync when the Watcher stops before being synced.
+func (w *Watcher) releaseSync() {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+
+	if !w.syncedClosed {
+		w.syncedClosed = true
+		close(w.synced)
+	}
+}
+
+func (h *PrefixHealth) update(state PrefixState, err error) {
+	if h.State != state {
+		h.Since = time.Now()
+	}
+	h.State = state
+	h.LastError = err
+}
@@ -0,0 +1,117 @@
+package goarken
+
+import (
+	"context"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A backend failing until it is repaired.
+type failingBackend struct {
+	Backend
+	err  error
+	lock sync.Mutex
+}
+
+func (b *failingBackend) failure() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
+
+func (b *failingBackend) repair() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.err = nil
+}
+
+func (b *failingBackend) Get(key string, recursive bool) (*Response, error) {
+	if err := b.failure(); err != nil {
+		return nil, err
+	}
+	return b.Backend.Get(key, recursive)
+}
+
+func (b *failingBackend) Watch(prefix string, waitIndex uint64, receiver chan *Response, stop chan bool) error {
+	if err := b.failure(); err != nil {
+		close(receiver)
+		return err
+	}
+	return b.Backend.Watch(prefix, waitIndex, receiver, stop)
+}
+
+func Test_WatcherSync(t *testing.T) {
+	var w *Watcher
+
+	Convey("Given a Watcher on a reachable backend", t, func() {
+		client := NewMemoryBackend()
+		client.Set("/domains/mydomain.com/type", "service", 0)
+		client.Set("/domains/mydomain.com/value", "my_service", 0)
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Domains:       make(map[string]*Domain),
+			Services:      make(map[string]*ServiceCluster),
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+
+		Convey("When it is synced", func() {
+			err := w.WaitForSync(context.Background())
+
+			Convey("Then the model is loaded", func() {
+				So(err, ShouldBeNil)
+				So(w.GetDomain("mydomain.com"), ShouldNotBeNil)
+				ready, err := w.Ready()
+				So(ready, ShouldBeTrue)
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Then every prefix is connected", func() {
+				health := w.Health()
+				So(health["/domains"].State, ShouldEqual, Connected)
+				So(health["/services"].State, ShouldEqual, Connected)
+			})
+		})
+	})
+
+	Convey("Given a Watcher on an unreachable backend", t, func() {
+		client := &failingBackend{Backend: NewMemoryBackend(), err: errors.New("connection refused")}
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Domains:       make(map[string]*Domain),
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+
+		Convey("When it is synced", func() {
+			err := w.WaitForSync(context.Background())
+
+			Convey("Then the load error is returned", func() {
+				So(err, ShouldEqual, client.err)
+				So(w.Health()["/domains"].State, ShouldEqual, Failed)
+			})
+		})
+
+		Convey("When the backend becomes reachable", func() {
+			w.WaitForSync(context.Background())
+			client.repair()
+
+			Convey("Then the Watcher gets ready", func() {
+				ready := false
+				for i := 0; i < 30 && !ready; i++ {
+					time.Sleep(100 * time.Millisecond)
+					ready, _ = w.Ready()
+				}
+				So(ready, ShouldBeTrue)
+				So(w.Health()["/domains"].State, ShouldEqual, Connected)
+			})
+		})
+	})
+}
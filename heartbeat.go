@@ -0,0 +1,116 @@
+package goarken
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHeartbeatTTL = 10 * time.Second
+	DefaultAliveValue   = "1"
+)
+
+// A Heartbeat keeps the alive status of a service instance set with a TTL,
+// from the process of the instance. If the process dies, the alive status
+// expires and Watchers report the instance as dead.
+type Heartbeat struct {
+	Client Backend
+	// Key of the instance, like /services/my_service/1
+	NodeKey string
+	// TTL of the alive status, rounded up to the second. DefaultHeartbeatTTL
+	// by default.
+	TTL time.Duration
+	// Delay between two refreshes, a third of the TTL by default.
+	Interval time.Duration
+	// Value of the alive status, DefaultAliveValue by default.
+	Value string
+
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	lock    sync.Mutex
+}
+
+func NewHeartbeat(client Backend, service *Service) *Heartbeat {
+	return &Heartbeat{Client: client, NodeKey: service.NodeKey}
+}
+
+// Start sets the alive status, and refreshes it until ctx is done or Stop is
+// called. Returns the error of the first write, the errors of the refreshes
+// are logged.
+func (h *Heartbeat) Start(ctx context.Context) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.cancel != nil {
+		return nil
+	}
+	if err := h.refresh(); err != nil {
+		return err
+	}
+
+	ctx, h.cancel = context.WithCancel(ctx)
+	h.stopped = make(chan struct{})
+	go h.run(ctx, h.stopped)
+	return nil
+}
+
+// Stop stops refreshing the alive status and removes it, so that the
+// instance stops being routed to without waiting for the TTL.
+func (h *Heartbeat) Stop() {
+	h.lock.Lock()
+	cancel, stopped := h.cancel, h.stopped
+	h.cancel = nil
+	h.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-stopped
+	}
+}
+
+func (h *Heartbeat) run(ctx context.Context, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(h.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.refresh(); err != nil {
+				glog.Warningf("Unable to refresh %s/status/alive: %v", h.NodeKey, err)
+			}
+		case <-ctx.Done():
+			if _, err := h.Client.Delete(h.NodeKey+"/status/alive", false); err != nil && err != ErrKeyNotFound {
+				glog.Warningf("Unable to remove %s/status/alive: %v", h.NodeKey, err)
+			}
+			return
+		}
+	}
+}
+
+func (h *Heartbeat) refresh() error {
+	value := h.Value
+	if value == "" {
+		value = DefaultAliveValue
+	}
+	_, err := h.Client.Set(h.NodeKey+"/status/alive", value, h.ttl())
+	return err
+}
+
+// TTL in seconds, rounded up.
+func (h *Heartbeat) ttl() uint64 {
+	ttl := h.TTL
+	if ttl <= 0 {
+		ttl = DefaultHeartbeatTTL
+	}
+	return uint64((ttl + time.Second - 1) / time.Second)
+}
+
+func (h *Heartbeat) interval() time.Duration {
+	if h.Interval > 0 {
+		return h.Interval
+	}
+	return time.Duration(h.ttl()) * time.Second / 3
+}
@@ -0,0 +1,86 @@
+package goarken
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func Test_Heartbeat(t *testing.T) {
+	var client *MemoryBackend
+	var heartbeat *Heartbeat
+
+	Convey("Given a heartbeat of a service instance", t, func() {
+		client = NewMemoryBackend()
+		heartbeat = NewHeartbeat(client, &Service{NodeKey: "/services/my_service/1"})
+		heartbeat.TTL = time.Second
+		heartbeat.Interval = 200 * time.Millisecond
+		So(heartbeat.Start(context.Background()), ShouldBeNil)
+		Reset(heartbeat.Stop)
+
+		Convey("When it runs longer than its TTL", func() {
+			time.Sleep(1500 * time.Millisecond)
+
+			Convey("Then the alive status is kept", func() {
+				response, err := client.Get("/services/my_service/1/status/alive", false)
+				So(err, ShouldBeNil)
+				So(response.Node.Value, ShouldEqual, DefaultAliveValue)
+				So(response.Node.TTL, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When it is stopped", func() {
+			heartbeat.Stop()
+
+			Convey("Then the alive status is removed", func() {
+				_, err := client.Get("/services/my_service/1/status/alive", false)
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+		})
+	})
+}
+
+func Test_WatcherDeadInstance(t *testing.T) {
+	var w *Watcher
+	var client *MemoryBackend
+
+	Convey("Given a Watcher coalescing the changes of a started instance", t, func() {
+		client = NewMemoryBackend()
+		client.Set("/services/my_service/1/location", `{"host":"127.0.0.1","port":8080}`, 0)
+		client.Set("/services/my_service/1/status/expected", STARTED_STATUS, 0)
+		client.Set("/services/my_service/1/status/current", STARTED_STATUS, 0)
+		client.Set("/services/my_service/1/status/alive", "1", 1)
+		w = &Watcher{
+			Client:         client,
+			DomainPrefix:   "/domains",
+			ServicePrefix:  "/services",
+			Services:       make(map[string]*ServiceCluster),
+			CoalesceWindow: 5 * time.Second,
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+		So(w.WaitForSync(context.Background()), ShouldBeNil)
+		updateChan := w.ListenFiltered(EventTypes(ServiceInstanceDead))
+
+		_, err := w.GetServiceCluster("my_service").Next()
+		So(err, ShouldBeNil)
+
+		Convey("When its alive status expires", func() {
+			event, err := waitFor(updateChan, 3*time.Second)
+			So(err, ShouldBeNil)
+
+			Convey("Then it is reported dead without waiting for the window", func() {
+				So(event.Type, ShouldEqual, ServiceInstanceDead)
+				So(event.Name, ShouldEqual, "my_service")
+				So(event.PrevService.Status.Alive, ShouldEqual, "1")
+				So(event.Service.Status.Alive, ShouldEqual, "")
+			})
+
+			Convey("Then it is not routed to anymore", func() {
+				_, err := w.GetServiceCluster("my_service").Next()
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,153 @@
+package goarken
+
+import (
+	"github.com/golang/glog"
+	"time"
+)
+
+const DefaultHistorySize = 100
+
+// A StatusChange records a change of the status of a service instance seen
+// by a Watcher.
+type StatusChange struct {
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	// Index of the instance in its cluster
+	Instance string `json:"instance"`
+	// Key and modified index of the change
+	Key   string `json:"key"`
+	Index uint64 `json:"index"`
+	// Statuses before and after the change, nil if the instance did not
+	// exist.
+	PrevStatus *Status `json:"prevStatus"`
+	Status     *Status `json:"status"`
+	// Computed statuses before and after the change, and the reason of the
+	// last one.
+	PrevComputed string       `json:"prevComputed"`
+	Computed     string       `json:"computed"`
+	Reason       StatusReason `json:"reason"`
+}
+
+// The last status changes of an instance.
+type statusRing struct {
+	changes []*StatusChange
+	// Position of the next change
+	next int
+	full bool
+}
+
+func (r *statusRing) add(change *StatusChange) {
+	r.changes[r.next] = change
+	r.next = (r.next + 1) % len(r.changes)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Returns the changes, oldest first.
+func (r *statusRing) list() []*StatusChange {
+	if !r.full {
+		return append([]*StatusChange(nil), r.changes[:r.next]...)
+	}
+	return append(append([]*StatusChange(nil), r.changes[r.next:]...), r.changes[:r.next]...)
+}
+
+// StatusHistory returns the last status changes of a service instance, oldest
+// first. The history of an instance is dropped when it is removed.
+func (w *Watcher) StatusHistory(serviceName string, index string) []*StatusChange {
+	w.historyLock.Lock()
+	defer w.historyLock.Unlock()
+
+	if ring := w.history[serviceName+"/"+index]; ring != nil {
+		return ring.list()
+	}
+	return nil
+}
+
+// Records the status changes of an event in the history and the audit log.
+func (w *Watcher) recordStatus(event *Event) {
+	for _, change := range statusChangesOf(event) {
+		w.recordChange(change, event.Type == ServiceInstanceRemoved || event.Type == ServiceClusterRemoved)
+	}
+}
+
+func (w *Watcher) recordChange(change *StatusChange, removed bool) {
+	if w.AuditLog != nil {
+		if err := w.AuditLog.Append(change); err != nil {
+			glog.Errorf("Unable to log the status change of %s/%s: %v", change.Service, change.Instance, err)
+		}
+	}
+
+	size := w.HistorySize
+	if size == 0 {
+		size = DefaultHistorySize
+	}
+
+	w.historyLock.Lock()
+	defer w.historyLock.Unlock()
+
+	key := change.Service + "/" + change.Instance
+	if removed || size < 0 {
+		delete(w.history, key)
+		return
+	}
+	if w.history == nil {
+		w.history = make(map[string]*statusRing)
+	}
+	ring := w.history[key]
+	if ring == nil {
+		ring = &statusRing{changes: make([]*StatusChange, size)}
+		w.history[key] = ring
+	}
+	ring.add(change)
+}
+
+// Returns the status changes of the instances of an event: the ones of
+// the removed cluster, or the one of the instance if its status changed.
+func statusChangesOf(event *Event) []*StatusChange {
+	switch event.Type {
+	case ServiceClusterRemoved:
+		var changes []*StatusChange
+		if event.Cluster != nil {
+			for _, instance := range event.Cluster.GetInstances() {
+				changes = append(changes, newStatusChange(event, instance, instance.Status, nil))
+			}
+		}
+		return changes
+
+	case ServiceInstanceAdded:
+		if event.Service == nil {
+			return nil
+		}
+		return []*StatusChange{newStatusChange(event, event.Service, nil, event.Service.Status)}
+
+	case ServiceInstanceUpdated:
+		if event.Service == nil || event.PrevService == nil || event.PrevService.Status.Equals(event.Service.Status) {
+			return nil
+		}
+		return []*StatusChange{newStatusChange(event, event.Service, event.PrevService.Status, event.Service.Status)}
+
+	case ServiceInstanceRemoved:
+		if event.PrevService == nil {
+			return nil
+		}
+		return []*StatusChange{newStatusChange(event, event.PrevService, event.PrevService.Status, nil)}
+	}
+	return nil
+}
+
+func newStatusChange(event *Event, instance *Service, prevStatus *Status, status *Status) *StatusChange {
+	result := status.Diagnose()
+	return &StatusChange{
+		Time:         time.Now().UTC(),
+		Service:      event.Name,
+		Instance:     instance.Index,
+		Key:          event.Key,
+		Index:        event.Index,
+		PrevStatus:   prevStatus,
+		Status:       status,
+		PrevComputed: prevStatus.Compute(),
+		Computed:     result.Status,
+		Reason:       result.Reason,
+	}
+}
@@ -0,0 +1,122 @@
+package goarken
+
+import (
+	"bytes"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_WatcherStatusHistory(t *testing.T) {
+	var w *Watcher
+	var client *MemoryBackend
+	var auditLog *FileAuditLog
+
+	Convey("Given a Watcher keeping the status history of a started instance", t, func() {
+		client = NewMemoryBackend()
+		client.Set("/services/my_service/1/status/expected", STARTED_STATUS, 0)
+		client.Set("/services/my_service/1/status/current", STARTED_STATUS, 0)
+		client.Set("/services/my_service/1/status/alive", "1", 0)
+
+		var err error
+		auditLog, err = OpenFileAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+		So(err, ShouldBeNil)
+
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Services:      make(map[string]*ServiceCluster),
+			HistorySize:   2,
+			AuditLog:      auditLog,
+		}
+		w.Start(context.Background())
+		// The Watcher is stopped first, so that it does not log into a
+		// closed audit log
+		Reset(func() {
+			w.Stop()
+			auditLog.Close()
+		})
+		So(w.WaitForSync(context.Background()), ShouldBeNil)
+		updateChan := w.ListenFiltered(EventTypes(ServiceInstanceUpdated, ServiceInstanceRemoved))
+
+		Convey("When it flaps between started and error", func() {
+			client.Delete("/services/my_service/1/status/alive", false)
+			waitFor(updateChan, time.Second)
+			client.Set("/services/my_service/1/status/alive", "1", 0)
+			waitFor(updateChan, time.Second)
+
+			Convey("Then the last changes are kept", func() {
+				history := w.StatusHistory("my_service", "1")
+				So(len(history), ShouldEqual, 2)
+
+				So(history[0].PrevComputed, ShouldEqual, STARTED_STATUS)
+				So(history[0].Computed, ShouldEqual, ERROR_STATUS)
+				So(history[0].Reason, ShouldEqual, ReasonNotAlive)
+				So(history[0].Key, ShouldEqual, "/services/my_service/1/status/alive")
+
+				So(history[1].PrevComputed, ShouldEqual, ERROR_STATUS)
+				So(history[1].Computed, ShouldEqual, STARTED_STATUS)
+				So(history[1].Index, ShouldBeGreaterThan, history[0].Index)
+			})
+
+			Convey("Then every change is in the audit log", func() {
+				changes, err := auditLog.Query(AuditQuery{Service: "my_service"})
+				So(err, ShouldBeNil)
+				So(len(changes), ShouldEqual, 3)
+				So(changes[0].PrevStatus, ShouldBeNil)
+				So(changes[0].Computed, ShouldEqual, STARTED_STATUS)
+
+				changes, _ = auditLog.Query(AuditQuery{Service: "my_service", Limit: 1})
+				So(len(changes), ShouldEqual, 1)
+				So(changes[0].Computed, ShouldEqual, STARTED_STATUS)
+				So(changes[0].Status.Alive, ShouldEqual, "1")
+
+				changes, _ = auditLog.Query(AuditQuery{Service: "other_service"})
+				So(changes, ShouldBeEmpty)
+			})
+
+			Convey("Then the changes can be exported as JSON lines", func() {
+				changes, _ := auditLog.Query(AuditQuery{})
+				var buffer bytes.Buffer
+				So(WriteStatusChanges(&buffer, changes), ShouldBeNil)
+				So(bytes.Count(buffer.Bytes(), []byte("\n")), ShouldEqual, 3)
+
+				read, err := ReadStatusChanges(&buffer)
+				So(err, ShouldBeNil)
+				So(read, ShouldResemble, changes)
+			})
+		})
+
+		Convey("When the instance is removed", func() {
+			client.Delete("/services/my_service/1", true)
+			waitFor(updateChan, time.Second)
+
+			Convey("Then its history is dropped", func() {
+				So(w.StatusHistory("my_service", "1"), ShouldBeEmpty)
+
+				changes, _ := auditLog.Query(AuditQuery{Instance: "1"})
+				So(changes[len(changes)-1].Status, ShouldBeNil)
+				So(changes[len(changes)-1].Computed, ShouldEqual, NA_STATUS)
+			})
+		})
+
+		Convey("When the audit log is closed", func() {
+			w.Stop()
+			auditLog.Append(&StatusChange{Service: "my_service", Instance: "2", Computed: STOPPED_STATUS})
+			So(auditLog.Close(), ShouldBeNil)
+
+			Convey("Then the queued changes are written", func() {
+				changes, err := auditLog.Query(AuditQuery{Instance: "2"})
+				So(err, ShouldBeNil)
+				So(len(changes), ShouldEqual, 1)
+			})
+
+			Convey("Then nothing can be appended anymore", func() {
+				So(auditLog.Append(&StatusChange{Service: "my_service", Instance: "2"}), ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,166 @@
+package goarken
+
+import "strings"
+
+// The lifecycle of a service instance: the states it goes through, the
+// transitions allowed between them, and the rules deriving its health from
+// its current and expected statuses and its liveness.
+
+// A StatusReason explains a computed status.
+type StatusReason string
+
+const (
+	// The instance has no status.
+	ReasonNoStatus StatusReason = "no_status"
+	// The current status is the expected one.
+	ReasonAsExpected StatusReason = "as_expected"
+	// The instance is moving to the expected status.
+	ReasonInProgress StatusReason = "in_progress"
+	// The instance is started but not alive.
+	ReasonNotAlive StatusReason = "not_alive"
+	// The current status is not the expected one, and does not lead to it.
+	ReasonUnexpectedCurrent StatusReason = "unexpected_current"
+	// The current status is not a state of the lifecycle.
+	ReasonUnknownCurrent StatusReason = "unknown_current"
+)
+
+// A StatusResult is the health of a service instance derived from its
+// status.
+type StatusResult struct {
+	// One of the statuses, like STARTED_STATUS or ERROR_STATUS
+	Status string
+	Reason StatusReason
+	// The expectation the status violates, empty if none
+	Expectation string
+}
+
+func (r *StatusResult) String() string {
+	if r.Expectation == "" {
+		return r.Status + " (" + string(r.Reason) + ")"
+	}
+	return r.Status + " (" + string(r.Reason) + ": " + r.Expectation + ")"
+}
+
+type aliveness int
+
+const (
+	anyAlive aliveness = iota
+	isAlive
+	notAlive
+)
+
+// A rule matches a current status, one of the expected statuses (any if
+// empty) and the liveness of an instance.
+type lifecycleRule struct {
+	current     string
+	expected    []string
+	alive       aliveness
+	status      string
+	reason      StatusReason
+	expectation string
+}
+
+// Rules computing the status, the first matching one applies.
+var lifecycleRules = []lifecycleRule{
+	{STOPPED_STATUS, []string{PASSIVATED_STATUS}, anyAlive, PASSIVATED_STATUS, ReasonAsExpected, ""},
+	{STOPPED_STATUS, []string{STOPPED_STATUS}, anyAlive, STOPPED_STATUS, ReasonAsExpected, ""},
+	{STOPPED_STATUS, nil, anyAlive, ERROR_STATUS, ReasonUnexpectedCurrent, "expected status is stopped or passivated"},
+
+	{PASSIVATED_STATUS, []string{PASSIVATED_STATUS}, anyAlive, PASSIVATED_STATUS, ReasonAsExpected, ""},
+	{PASSIVATED_STATUS, nil, anyAlive, WARNING_STATUS, ReasonUnexpectedCurrent, "expected status is passivated"},
+
+	{STARTING_STATUS, []string{STARTED_STATUS}, anyAlive, STARTING_STATUS, ReasonInProgress, ""},
+	{STARTING_STATUS, nil, anyAlive, ERROR_STATUS, ReasonUnexpectedCurrent, "expected status is started"},
+
+	{STARTED_STATUS, []string{STARTED_STATUS}, isAlive, STARTED_STATUS, ReasonAsExpected, ""},
+	{STARTED_STATUS, []string{STARTED_STATUS}, notAlive, ERROR_STATUS, ReasonNotAlive, "instance is alive"},
+	{STARTED_STATUS, nil, anyAlive, WARNING_STATUS, ReasonUnexpectedCurrent, "expected status is started"},
+
+	{STOPPING_STATUS, []string{STOPPED_STATUS}, anyAlive, STOPPED_STATUS, ReasonInProgress, ""},
+	{STOPPING_STATUS, []string{PASSIVATED_STATUS}, anyAlive, PASSIVATED_STATUS, ReasonInProgress, ""},
+	{STOPPING_STATUS, nil, anyAlive, ERROR_STATUS, ReasonUnexpectedCurrent, "expected status is stopped or passivated"},
+}
+
+func (rule *lifecycleRule) matches(s *Status) bool {
+	if rule.current != s.Current {
+		return false
+	}
+	if rule.alive == isAlive && s.Alive == "" || rule.alive == notAlive && s.Alive != "" {
+		return false
+	}
+	if len(rule.expected) == 0 {
+		return true
+	}
+	for _, expected := range rule.expected {
+		if expected == s.Expected {
+			return true
+		}
+	}
+	return false
+}
+
+// Diagnose computes the status of a service instance with the reason of the
+// result, and the expectation it violates.
+func (s *Status) Diagnose() *StatusResult {
+	if s == nil {
+		return &StatusResult{Status: NA_STATUS, Reason: ReasonNoStatus}
+	}
+	for i := range lifecycleRules {
+		rule := &lifecycleRules[i]
+		if rule.matches(s) {
+			return &StatusResult{Status: rule.status, Reason: rule.reason, Expectation: rule.expectation}
+		}
+	}
+	return &StatusResult{
+		Status:      ERROR_STATUS,
+		Reason:      ReasonUnknownCurrent,
+		Expectation: "current status is one of " + strings.Join(lifecycleStates, ", "),
+	}
+}
+
+// States of the lifecycle.
+var lifecycleStates = []string{STOPPED_STATUS, STARTING_STATUS, STARTED_STATUS, STOPPING_STATUS, PASSIVATED_STATUS}
+
+// Current and expected statuses written by Transition for each state.
+var transitionStates = map[string]*Status{
+	STOPPED_STATUS:    {Current: STOPPED_STATUS, Expected: STOPPED_STATUS},
+	STARTING_STATUS:   {Current: STARTING_STATUS, Expected: STARTED_STATUS},
+	STARTED_STATUS:    {Current: STARTED_STATUS, Expected: STARTED_STATUS},
+	STOPPING_STATUS:   {Current: STOPPING_STATUS, Expected: STOPPED_STATUS},
+	PASSIVATED_STATUS: {Current: PASSIVATED_STATUS, Expected: PASSIVATED_STATUS},
+}
+
+// Allowed transitions between the states of a service instance.
+var statusTransitions = map[string][]string{
+	STOPPED_STATUS:    {STARTING_STATUS, PASSIVATED_STATUS},
+	STARTING_STATUS:   {STARTED_STATUS, STOPPING_STATUS},
+	STARTED_STATUS:    {STOPPING_STATUS},
+	STOPPING_STATUS:   {STOPPED_STATUS, PASSIVATED_STATUS},
+	PASSIVATED_STATUS: {STARTING_STATUS},
+}
+
+// A TransitionError is returned for a transition that the state machine
+// doesn't allow.
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return "Invalid status transition from " + e.From + " to " + e.To
+}
+
+// CanTransition tells if a service instance can go from a state to another.
+func CanTransition(from string, to string) bool {
+	for _, state := range statusTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transitions returns the states a service instance can go to from a state.
+func Transitions(from string) []string {
+	return append([]string(nil), statusTransitions[from]...)
+}
@@ -0,0 +1,82 @@
+package goarken
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func Test_Diagnose(t *testing.T) {
+	Convey("Given statuses", t, func() {
+		Convey("When the current status is the expected one", func() {
+			result := (&Status{Current: STARTED_STATUS, Expected: STARTED_STATUS, Alive: "1"}).Diagnose()
+
+			Convey("Then no expectation is violated", func() {
+				So(result, ShouldResemble, &StatusResult{Status: STARTED_STATUS, Reason: ReasonAsExpected})
+			})
+		})
+
+		Convey("When an instance is stopping to be passivated", func() {
+			result := (&Status{Current: STOPPING_STATUS, Expected: PASSIVATED_STATUS}).Diagnose()
+
+			Convey("Then it is in progress", func() {
+				So(result.Status, ShouldEqual, PASSIVATED_STATUS)
+				So(result.Reason, ShouldEqual, ReasonInProgress)
+			})
+		})
+
+		Convey("When an instance is starting while it is expected to be passivated", func() {
+			result := (&Status{Current: STARTING_STATUS, Expected: PASSIVATED_STATUS}).Diagnose()
+
+			Convey("Then the error is explained", func() {
+				So(result.Status, ShouldEqual, ERROR_STATUS)
+				So(result.Reason, ShouldEqual, ReasonUnexpectedCurrent)
+				So(result.String(), ShouldEqual, "error (unexpected_current: expected status is started)")
+			})
+		})
+
+		Convey("When a started instance is not alive", func() {
+			result := (&Status{Current: STARTED_STATUS, Expected: STARTED_STATUS}).Diagnose()
+
+			Convey("Then it is in error", func() {
+				So(result.Status, ShouldEqual, ERROR_STATUS)
+				So(result.Reason, ShouldEqual, ReasonNotAlive)
+			})
+		})
+
+		Convey("When the current status is unknown", func() {
+			result := (&Status{Current: "paused", Expected: STARTED_STATUS}).Diagnose()
+
+			Convey("Then it is in error", func() {
+				So(result.Status, ShouldEqual, ERROR_STATUS)
+				So(result.Reason, ShouldEqual, ReasonUnknownCurrent)
+			})
+		})
+
+		Convey("When there is no status", func() {
+			var status *Status
+
+			Convey("Then it is not available", func() {
+				So(status.Diagnose(), ShouldResemble, &StatusResult{Status: NA_STATUS, Reason: ReasonNoStatus})
+			})
+		})
+	})
+}
+
+func Test_Transitions(t *testing.T) {
+	Convey("Given the lifecycle", t, func() {
+		Convey("Then a stopped instance can be started or passivated", func() {
+			So(Transitions(STOPPED_STATUS), ShouldResemble, []string{STARTING_STATUS, PASSIVATED_STATUS})
+			So(CanTransition(STOPPED_STATUS, STARTING_STATUS), ShouldBeTrue)
+		})
+
+		Convey("Then a started instance can't be passivated without stopping", func() {
+			So(CanTransition(STARTED_STATUS, PASSIVATED_STATUS), ShouldBeFalse)
+		})
+
+		Convey("Then every state has a transition", func() {
+			for _, state := range lifecycleStates {
+				So(Transitions(state), ShouldNotBeEmpty)
+			}
+		})
+	})
+}
@@ -0,0 +1,425 @@
+package goarken
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of events kept to serve watches that start in the past, like
+	// etcd does.
+	memoryHistorySize = 1000
+)
+
+// A MemoryBackend is a Backend that keeps the model in memory. It mimics the
+// etcd v2 semantics (directories, indexes, TTLs and watches) so that it can
+// be used in tests or in single node setups.
+type MemoryBackend struct {
+	lock     sync.Mutex
+	root     *memoryNode
+	index    uint64
+	history  []*Response
+	watchers map[*memoryWatch]bool
+}
+
+type memoryNode struct {
+	key           string
+	value         string
+	dir           bool
+	children      map[string]*memoryNode
+	parent        *memoryNode
+	expiration    *time.Time
+	expireTimer   *time.Timer
+	createdIndex  uint64
+	modifiedIndex uint64
+}
+
+type memoryWatch struct {
+	prefix    string
+	waitIndex uint64
+	pending   []*Response
+	notify    chan struct{}
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		root: &memoryNode{
+			key:      "/",
+			dir:      true,
+			children: make(map[string]*memoryNode),
+		},
+		watchers: make(map[*memoryWatch]bool),
+	}
+}
+
+func (b *MemoryBackend) Get(key string, recursive bool) (*Response, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	node := b.find(cleanKey(key))
+	if node == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	depth := 1
+	if recursive {
+		depth = -1
+	}
+	return &Response{Action: "get", Node: node.export(depth), Index: b.index}, nil
+}
+
+func (b *MemoryBackend) Set(key string, value string, ttl uint64) (*Response, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	key = cleanKey(key)
+	if key == "/" {
+		return nil, errors.New("Root is read only")
+	}
+
+	node := b.find(key)
+	if node != nil && node.dir {
+		return nil, fmt.Errorf("Not a file: %s", key)
+	}
+	return b.set(key, node, value, ttl, "set")
+}
+
+func (b *MemoryBackend) Create(key string, value string, ttl uint64) (*Response, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	key = cleanKey(key)
+	node := b.find(key)
+	if node != nil {
+		return nil, ErrKeyExists
+	}
+	return b.set(key, node, value, ttl, "create")
+}
+
+func (b *MemoryBackend) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	key = cleanKey(key)
+	node := b.find(key)
+	if node == nil {
+		return nil, ErrKeyNotFound
+	}
+	if node.dir {
+		return nil, fmt.Errorf("Not a file: %s", key)
+	}
+	if (prevValue != "" && node.value != prevValue) || (prevIndex != 0 && node.modifiedIndex != prevIndex) {
+		return nil, ErrCompareFailed
+	}
+	return b.set(key, node, value, ttl, "compareAndSwap")
+}
+
+// Txn validates all the ops before writing them at a single index.
+func (b *MemoryBackend) Txn(ops []*TxnOp) (uint64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, op := range ops {
+		key := cleanKey(op.Key)
+		if key == "/" {
+			return 0, errors.New("Root is read only")
+		}
+		node := b.find(key)
+		if node != nil && node.dir {
+			return 0, fmt.Errorf("Not a file: %s", key)
+		}
+		var current *Node
+		if node != nil {
+			current = node.export(0)
+		} else {
+			for dir := parentKey(key); dir != "/"; dir = parentKey(dir) {
+				if parent := b.find(dir); parent != nil && !parent.dir {
+					return 0, fmt.Errorf("Not a directory: %s", dir)
+				}
+			}
+		}
+		if err := op.Check(current); err != nil {
+			return 0, err
+		}
+	}
+
+	written := false
+	for _, op := range ops {
+		if op.CheckOnly {
+			continue
+		}
+		if !written {
+			b.index++
+			written = true
+		}
+		key := cleanKey(op.Key)
+		if _, err := b.put(key, b.find(key), op.Value, 0, op.Action()); err != nil {
+			return 0, err
+		}
+	}
+	return b.index, nil
+}
+
+// Stores value in node, created if nil, at a new index. Must be called with
+// the lock held.
+func (b *MemoryBackend) set(key string, node *memoryNode, value string, ttl uint64, action string) (*Response, error) {
+	b.index++
+	response, err := b.put(key, node, value, ttl, action)
+	if err != nil {
+		b.index--
+	}
+	return response, err
+}
+
+// Stores value in node, created if nil, at the current index.
+func (b *MemoryBackend) put(key string, node *memoryNode, value string, ttl uint64, action string) (*Response, error) {
+	var prevNode *Node
+	if node == nil {
+		parent, err := b.mkdirs(parentKey(key))
+		if err != nil {
+			return nil, err
+		}
+		node = &memoryNode{key: key, parent: parent, createdIndex: b.index}
+		parent.children[key] = node
+	} else {
+		prevNode = node.export(0)
+		node.stopTimer()
+	}
+
+	node.value = value
+	node.modifiedIndex = b.index
+	node.expiration = nil
+	if ttl > 0 {
+		expiration := time.Now().Add(time.Duration(ttl) * time.Second)
+		node.expiration = &expiration
+		node.expireTimer = time.AfterFunc(time.Duration(ttl)*time.Second, func() {
+			b.expire(node)
+		})
+	}
+
+	response := &Response{Action: action, Node: node.export(0), PrevNode: prevNode, Index: b.index}
+	b.notify(response)
+	return response, nil
+}
+
+func (b *MemoryBackend) Delete(key string, recursive bool) (*Response, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	key = cleanKey(key)
+	node := b.find(key)
+	if node == nil {
+		return nil, ErrKeyNotFound
+	}
+	if node == b.root {
+		return nil, errors.New("Root is read only")
+	}
+	if node.dir && !recursive {
+		return nil, fmt.Errorf("Not a file: %s", key)
+	}
+
+	b.index++
+	response := &Response{
+		Action:   "delete",
+		Node:     &Node{Key: key, Dir: node.dir, CreatedIndex: node.createdIndex, ModifiedIndex: b.index},
+		PrevNode: node.export(0),
+		Index:    b.index,
+	}
+	b.remove(node)
+	b.notify(response)
+	return response, nil
+}
+
+func (b *MemoryBackend) Watch(prefix string, waitIndex uint64, receiver chan *Response, stop chan bool) error {
+	defer close(receiver)
+
+	prefix = cleanKey(prefix)
+	watch := &memoryWatch{prefix: prefix, waitIndex: waitIndex, notify: make(chan struct{}, 1)}
+
+	b.lock.Lock()
+	if waitIndex > 0 && waitIndex <= b.index {
+		if len(b.history) > 0 && waitIndex < b.history[0].Index {
+			b.lock.Unlock()
+			return ErrIndexCleared
+		}
+		for _, response := range b.history {
+			if watch.matches(response) {
+				watch.pending = append(watch.pending, response)
+			}
+		}
+	}
+	b.watchers[watch] = true
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		delete(b.watchers, watch)
+		b.lock.Unlock()
+	}()
+
+	for {
+		b.lock.Lock()
+		pending := watch.pending
+		watch.pending = nil
+		b.lock.Unlock()
+
+		for _, response := range pending {
+			select {
+			case receiver <- response:
+			case <-stop:
+				return ErrWatchStopped
+			}
+		}
+
+		select {
+		case <-watch.notify:
+		case <-stop:
+			return ErrWatchStopped
+		}
+	}
+}
+
+// Removes a key whose TTL has been reached.
+func (b *MemoryBackend) expire(node *memoryNode) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// The key may have been deleted or refreshed in the meantime
+	if b.find(node.key) != node || node.expiration == nil || time.Now().Before(*node.expiration) {
+		return
+	}
+
+	b.index++
+	response := &Response{
+		Action:   "expire",
+		Node:     &Node{Key: node.key, CreatedIndex: node.createdIndex, ModifiedIndex: b.index},
+		PrevNode: node.export(0),
+		Index:    b.index,
+	}
+	b.remove(node)
+	b.notify(response)
+}
+
+// Records a change and dispatches it to the matching watches.
+func (b *MemoryBackend) notify(response *Response) {
+	b.history = append(b.history, response)
+	if len(b.history) > memoryHistorySize {
+		b.history = b.history[len(b.history)-memoryHistorySize:]
+	}
+
+	for watch := range b.watchers {
+		if watch.matches(response) {
+			watch.pending = append(watch.pending, response)
+			select {
+			case watch.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (b *MemoryBackend) find(key string) *memoryNode {
+	if key == "/" {
+		return b.root
+	}
+	parent := b.find(parentKey(key))
+	if parent == nil || !parent.dir {
+		return nil
+	}
+	return parent.children[key]
+}
+
+// Creates the directory at key and all its missing parents.
+func (b *MemoryBackend) mkdirs(key string) (*memoryNode, error) {
+	if key == "/" {
+		return b.root, nil
+	}
+	parent, err := b.mkdirs(parentKey(key))
+	if err != nil {
+		return nil, err
+	}
+	node := parent.children[key]
+	if node == nil {
+		node = &memoryNode{
+			key:           key,
+			dir:           true,
+			children:      make(map[string]*memoryNode),
+			parent:        parent,
+			createdIndex:  b.index,
+			modifiedIndex: b.index,
+		}
+		parent.children[key] = node
+	} else if !node.dir {
+		return nil, fmt.Errorf("Not a directory: %s", key)
+	}
+	return node, nil
+}
+
+func (b *MemoryBackend) remove(node *memoryNode) {
+	node.walk(func(n *memoryNode) {
+		n.stopTimer()
+	})
+	delete(node.parent.children, node.key)
+}
+
+func (w *memoryWatch) matches(response *Response) bool {
+	if response.Index < w.waitIndex {
+		return false
+	}
+	key := response.Node.Key
+	return w.prefix == "/" || key == w.prefix || strings.HasPrefix(key, w.prefix+"/")
+}
+
+// Exports the node and its children up to depth levels (-1 means all
+// levels).
+func (n *memoryNode) export(depth int) *Node {
+	node := &Node{
+		Key:           n.key,
+		Value:         n.value,
+		Dir:           n.dir,
+		CreatedIndex:  n.createdIndex,
+		ModifiedIndex: n.modifiedIndex,
+	}
+	if n.expiration != nil {
+		expiration := *n.expiration
+		node.Expiration = &expiration
+		node.TTL = int64(expiration.Sub(time.Now())/time.Second) + 1
+	}
+	if n.dir && depth != 0 {
+		for _, child := range n.children {
+			node.Nodes = append(node.Nodes, child.export(depth-1))
+		}
+		sort.Sort(node.Nodes)
+	}
+	return node
+}
+
+func (n *memoryNode) walk(f func(*memoryNode)) {
+	f(n)
+	for _, child := range n.children {
+		child.walk(f)
+	}
+}
+
+func (n *memoryNode) stopTimer() {
+	if n.expireTimer != nil {
+		n.expireTimer.Stop()
+		n.expireTimer = nil
+	}
+}
+
+func cleanKey(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+func parentKey(key string) string {
+	index := strings.LastIndex(key, "/")
+	if index <= 0 {
+		return "/"
+	}
+	return key[:index]
+}
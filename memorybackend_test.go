@@ -0,0 +1,185 @@
+package goarken
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func Test_MemoryBackend(t *testing.T) {
+	var b *MemoryBackend
+
+	Convey("Given a memory backend", t, func() {
+		b = NewMemoryBackend()
+
+		Convey("When a key is set", func() {
+			response, err := b.Set("/services/my_service/1/domain", "mydomain.com", 0)
+			So(err, ShouldBeNil)
+			So(response.Action, ShouldEqual, "set")
+
+			Convey("Then it can be read back", func() {
+				response, err := b.Get("/services/my_service/1/domain", false)
+				So(err, ShouldBeNil)
+				So(response.Node.Value, ShouldEqual, "mydomain.com")
+				So(response.Node.ModifiedIndex, ShouldEqual, 1)
+			})
+
+			Convey("Then its parents are directories", func() {
+				response, err := b.Get("/services", true)
+				So(err, ShouldBeNil)
+				So(response.Node.Dir, ShouldBeTrue)
+				So(response.Node.Nodes[0].Key, ShouldEqual, "/services/my_service")
+				So(response.Node.Nodes[0].Nodes[0].Nodes[0].Value, ShouldEqual, "mydomain.com")
+			})
+
+			Convey("Then a non recursive get only returns the first level", func() {
+				response, err := b.Get("/services", false)
+				So(err, ShouldBeNil)
+				So(len(response.Node.Nodes), ShouldEqual, 1)
+				So(response.Node.Nodes[0].Nodes, ShouldBeNil)
+			})
+
+			Convey("Then it can't be used as a directory", func() {
+				_, err := b.Set("/services/my_service/1/domain/sub", "value", 0)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then its directory can't be deleted without recursion", func() {
+				_, err := b.Delete("/services/my_service", false)
+				So(err, ShouldNotBeNil)
+
+				_, err = b.Delete("/services/my_service", true)
+				So(err, ShouldBeNil)
+
+				_, err = b.Get("/services/my_service/1/domain", false)
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+
+			Convey("Then it can't be created again", func() {
+				_, err := b.Create("/services/my_service/1/domain", "other.com", 0)
+				So(err, ShouldEqual, ErrKeyExists)
+
+				_, err = b.Create("/services/my_service", "other.com", 0)
+				So(err, ShouldEqual, ErrKeyExists)
+			})
+
+			Convey("Then it is swapped only if it is unchanged", func() {
+				_, err := b.CompareAndSwap("/services/my_service/1/domain", "other.com", 0, "unknown.com", 0)
+				So(err, ShouldEqual, ErrCompareFailed)
+
+				_, err = b.CompareAndSwap("/services/my_service/1/domain", "other.com", 0, "", 2)
+				So(err, ShouldEqual, ErrCompareFailed)
+
+				response, err := b.CompareAndSwap("/services/my_service/1/domain", "other.com", 0, "mydomain.com", 1)
+				So(err, ShouldBeNil)
+				So(response.Action, ShouldEqual, "compareAndSwap")
+				So(response.PrevNode.Value, ShouldEqual, "mydomain.com")
+				So(response.Node.Value, ShouldEqual, "other.com")
+			})
+
+			Convey("Then it is written with other keys in a transaction", func() {
+				index, err := b.Txn([]*TxnOp{
+					{Key: "/services/my_service/1/domain", Value: "other.com", PrevValue: "mydomain.com"},
+					{Key: "/services/my_service/1/location", Value: "{}", Create: true},
+				})
+				So(err, ShouldBeNil)
+				So(index, ShouldEqual, 2)
+
+				response, _ := b.Get("/services/my_service/1", true)
+				So(response.Node.Nodes[0].Value, ShouldEqual, "other.com")
+				So(response.Node.Nodes[0].ModifiedIndex, ShouldEqual, 2)
+				So(response.Node.Nodes[1].ModifiedIndex, ShouldEqual, 2)
+			})
+
+			Convey("Then a transaction with a failing condition writes nothing", func() {
+				_, err := b.Txn([]*TxnOp{
+					{Key: "/services/my_service/1/location", Value: "{}", Create: true},
+					{Key: "/services/my_service/1/domain", Value: "other.com", PrevIndex: 2},
+				})
+				So(err, ShouldEqual, ErrCompareFailed)
+
+				_, err = b.Get("/services/my_service/1/location", false)
+				So(err, ShouldEqual, ErrKeyNotFound)
+				response, _ := b.Get("/", false)
+				So(response.Index, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When a missing key is swapped", func() {
+			_, err := b.CompareAndSwap("/services/my_service/1/domain", "other.com", 0, "mydomain.com", 0)
+
+			Convey("Then it is not found", func() {
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+		})
+
+		Convey("When a key is missing", func() {
+			_, err := b.Get("/domains/unknown.com", true)
+
+			Convey("Then it is not found", func() {
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+		})
+
+		Convey("When a key is watched", func() {
+			receiver := make(chan *Response, 10)
+			stop := make(chan bool)
+			result := make(chan error)
+			go func() {
+				result <- b.Watch("/services", 1, receiver, stop)
+			}()
+
+			b.Set("/domains/mydomain.com/type", "service", 0)
+			b.Set("/services/my_service/1/domain", "mydomain.com", 0)
+			b.Delete("/services/my_service", true)
+
+			Convey("Then it receives the changes under its prefix", func() {
+				response := <-receiver
+				So(response.Action, ShouldEqual, "set")
+				So(response.Node.Key, ShouldEqual, "/services/my_service/1/domain")
+
+				response = <-receiver
+				So(response.Action, ShouldEqual, "delete")
+				So(response.Node.Key, ShouldEqual, "/services/my_service")
+
+				close(stop)
+				So(<-result, ShouldEqual, ErrWatchStopped)
+			})
+		})
+
+		Convey("When a watch starts at an index older than the history", func() {
+			for i := 0; i < memoryHistorySize+1; i++ {
+				b.Set("/services/my_service/1/lastAccess", "2015-01-01 00:00:00", 0)
+			}
+			err := b.Watch("/services", 1, make(chan *Response, 10), make(chan bool))
+
+			Convey("Then the index is cleared", func() {
+				So(err, ShouldEqual, ErrIndexCleared)
+			})
+		})
+
+		Convey("When a key has a TTL", func() {
+			b.Set("/services/my_service/1/status/alive", "1", 1)
+			receiver := make(chan *Response, 10)
+			stop := make(chan bool)
+			go b.Watch("/services", 0, receiver, stop)
+			defer close(stop)
+
+			response, _ := b.Get("/services/my_service/1/status/alive", false)
+			So(response.Node.TTL, ShouldEqual, 1)
+
+			Convey("Then it expires", func() {
+				select {
+				case response := <-receiver:
+					So(response.Action, ShouldEqual, "expire")
+					So(response.PrevNode.Value, ShouldEqual, "1")
+				case <-time.After(3 * time.Second):
+					So("timeout", ShouldEqual, "expire")
+				}
+
+				_, err := b.Get("/services/my_service/1/status/alive", false)
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+		})
+	})
+}
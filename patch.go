@@ -0,0 +1,181 @@
+package goarken
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Changes of these keys of a service instance are applied from the watch
+// response, other changes need the service to be read again.
+var servicePatches = map[string]func(service *Service, value string){
+	"location": func(service *Service, value string) {
+		service.Location = &Location{}
+		service.setLocation(value)
+	},
+	"domain": func(service *Service, value string) {
+		service.Domain = value
+	},
+	"lastAccess": func(service *Service, value string) {
+		service.LastAccess = nil
+		service.setLastAccess(value)
+	},
+	"config/gogeta": func(service *Service, value string) {
+		service.Config = &ServiceConfig{Robots: ""}
+		service.setConfig(value)
+	},
+	"status/alive": func(service *Service, value string) {
+		serviceStatus(service).Alive = value
+	},
+	"status/current": func(service *Service, value string) {
+		serviceStatus(service).Current = value
+	},
+	"status/expected": func(service *Service, value string) {
+		serviceStatus(service).Expected = value
+	},
+}
+
+// Deleting any other key, like the last key of an instance on a backend
+// without directories, needs the service to be read again.
+var serviceDeletionPatches = map[string]bool{
+	"status/alive": true,
+}
+
+func serviceStatus(service *Service) *Status {
+	if service.Status == nil {
+		service.Status = &Status{Service: service}
+	}
+	return service.Status
+}
+
+func isDeletion(action string) bool {
+	return action == "delete" || action == "expire" || action == "compareAndDelete"
+}
+
+// Applies changes of known instances of a service cluster, in order, and
+// broadcasts the updated instances. Returns false without changing anything
+// if one of the changes can't be applied unambiguously.
+func (w *Watcher) patchService(serviceName string, changes []*Response) bool {
+	clusterKey := w.ServicePrefix + "/" + serviceName
+
+	w.lock.Lock()
+	cluster := w.Services[serviceName]
+	if cluster == nil {
+		w.lock.Unlock()
+		return false
+	}
+
+	// Patched copies of the instances, by index
+	patched := make(map[string]*Service)
+	var indexes []string
+	for _, change := range changes {
+		node := change.Node
+		if node.Dir || !strings.HasPrefix(node.Key, clusterKey+"/") {
+			w.lock.Unlock()
+			return false
+		}
+		parts := strings.SplitN(strings.TrimPrefix(node.Key, clusterKey+"/"), "/", 2)
+		if len(parts) != 2 {
+			w.lock.Unlock()
+			return false
+		}
+		index, field := parts[0], parts[1]
+		if _, err := strconv.Atoi(index); err != nil {
+			w.lock.Unlock()
+			return false
+		}
+
+		patch := servicePatches[field]
+		deleted := isDeletion(change.Action)
+		if patch == nil || (deleted && !serviceDeletionPatches[field]) {
+			w.lock.Unlock()
+			return false
+		}
+
+		service := patched[index]
+		if service == nil {
+			actual := cluster.Get(index)
+			if actual == nil {
+				// Other keys of a new instance may already exist
+				w.lock.Unlock()
+				return false
+			}
+			service = actual.copy()
+			patched[index] = service
+			indexes = append(indexes, index)
+		}
+
+		value := node.Value
+		if deleted {
+			value = ""
+		}
+		patch(service, value)
+	}
+
+	last := changes[len(changes)-1].Node
+	var events []*Event
+	for _, index := range indexes {
+		actual := cluster.Get(index)
+		service := patched[index]
+		cluster.Add(service)
+
+		if !actual.Equals(service) {
+			events = append(events, &Event{
+				Type:        ServiceInstanceUpdated,
+				Key:         last.Key,
+				Index:       last.ModifiedIndex,
+				Name:        serviceName,
+				PrevService: actual,
+				Service:     service,
+				Cluster:     cluster,
+			})
+		}
+	}
+	w.lock.Unlock()
+
+	w.broadcast(events...)
+	return true
+}
+
+// Applies a change of the type or value of a known domain. Returns false if
+// the domain needs to be read again.
+func (w *Watcher) patchDomain(domainName string, node *Node, action string) bool {
+	domainKey := w.DomainPrefix + "/" + domainName
+	if node.Dir || isDeletion(action) {
+		return false
+	}
+
+	w.lock.Lock()
+	actual := w.Domains[domainName]
+	if actual == nil {
+		w.lock.Unlock()
+		return false
+	}
+
+	domain := &Domain{Typ: actual.Typ, Value: actual.Value}
+	switch node.Key {
+	case domainKey + "/type":
+		domain.Typ = node.Value
+	case domainKey + "/value":
+		domain.Value = node.Value
+	default:
+		w.lock.Unlock()
+		return false
+	}
+
+	var event *Event
+	if domain.Typ != "" && domain.Value != "" && !domain.Equals(actual) {
+		w.Domains[domainName] = domain
+		event = &Event{
+			Type:       DomainUpdated,
+			Key:        node.Key,
+			Index:      node.ModifiedIndex,
+			Name:       domainName,
+			PrevDomain: actual,
+			Domain:     domain,
+		}
+	}
+	w.lock.Unlock()
+
+	w.broadcast(event)
+	return true
+}
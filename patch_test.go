@@ -0,0 +1,98 @@
+package goarken
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A backend counting the reads.
+type countingBackend struct {
+	Backend
+	gets int64
+}
+
+func (b *countingBackend) Get(key string, recursive bool) (*Response, error) {
+	atomic.AddInt64(&b.gets, 1)
+	return b.Backend.Get(key, recursive)
+}
+
+func (b *countingBackend) getCount() int64 {
+	return atomic.LoadInt64(&b.gets)
+}
+
+func Test_WatcherPatches(t *testing.T) {
+	var w *Watcher
+	var client *countingBackend
+
+	Convey("Given a Watcher on a loaded model", t, func() {
+		client = &countingBackend{Backend: NewMemoryBackend()}
+		client.Set("/domains/mydomain.com/type", "service", 0)
+		client.Set("/domains/mydomain.com/value", "my_service", 0)
+		client.Set("/services/my_service/1/domain", "mydomain.com", 0)
+		client.Set("/services/my_service/1/status/expected", STARTED_STATUS, 0)
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Domains:       make(map[string]*Domain),
+			Services:      make(map[string]*ServiceCluster),
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+		So(w.WaitForSync(context.Background()), ShouldBeNil)
+		updateChan := w.Listen()
+		gets := client.getCount()
+
+		Convey("When the status of an instance changes", func() {
+			client.Set("/services/my_service/1/status/current", STARTING_STATUS, 0)
+			event, _ := waitFor(updateChan, time.Second)
+
+			Convey("Then it is applied without reading the service", func() {
+				So(event.Type, ShouldEqual, ServiceInstanceUpdated)
+				So(event.PrevService.Status.Current, ShouldEqual, "")
+				So(event.Service.Status.Current, ShouldEqual, STARTING_STATUS)
+				So(event.Service.Status.Expected, ShouldEqual, STARTED_STATUS)
+				So(event.Service.Status.Service, ShouldEqual, event.Service)
+				So(client.getCount(), ShouldEqual, gets)
+			})
+		})
+
+		Convey("When the location and the last access of an instance change", func() {
+			client.Set("/services/my_service/1/lastAccess", "2015-01-01 00:00:00", 0)
+			client.Set("/services/my_service/1/location", `{"host":"127.0.0.1","port":8080}`, 0)
+			event, _ := waitFor(updateChan, time.Second)
+
+			Convey("Then they are applied without reading the service", func() {
+				So(event.Service.Location.Port, ShouldEqual, 8080)
+				So(event.PrevService.Location.Port, ShouldEqual, 0)
+				So(event.Service.LastAccess, ShouldNotBeNil)
+				So(client.getCount(), ShouldEqual, gets)
+			})
+		})
+
+		Convey("When the value of a domain changes", func() {
+			client.Set("/domains/mydomain.com/value", "other_service", 0)
+			event, _ := waitFor(updateChan, time.Second)
+
+			Convey("Then it is applied without reading the domain", func() {
+				So(event.Type, ShouldEqual, DomainUpdated)
+				So(event.Domain.Value, ShouldEqual, "other_service")
+				So(w.GetDomain("mydomain.com").Value, ShouldEqual, "other_service")
+				So(client.getCount(), ShouldEqual, gets)
+			})
+		})
+
+		Convey("When a new instance is added", func() {
+			client.Set("/services/my_service/2/domain", "mydomain.com", 0)
+			event, _ := waitFor(updateChan, time.Second)
+
+			Convey("Then the service is read again", func() {
+				So(event.Type, ShouldEqual, ServiceInstanceAdded)
+				So(client.getCount(), ShouldEqual, gets+1)
+			})
+		})
+	})
+}
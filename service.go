@@ -3,17 +3,18 @@ package goarken
 import (
 	"encoding/json"
 	"errors"
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/golang/glog"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"github.com/Sirupsen/logrus"
 )
 
 var (
-	serviceRegexp = regexp.MustCompile("/services/(.*)(/.*)*")
+	serviceRegexp     = regexp.MustCompile("/services/(.*)(/.*)*")
+	serviceRegexpLock sync.RWMutex
 )
 
 type Location struct {
@@ -22,9 +23,18 @@ type Location struct {
 }
 
 func SetServicePrefix(servicePrefix string) {
+	serviceRegexpLock.Lock()
+	defer serviceRegexpLock.Unlock()
 	serviceRegexp = regexp.MustCompile(servicePrefix + "/(.*)(/.*)*")
 }
 
+// The prefix may be changed while watchers match their keys.
+func matchServiceRegexp(key string) []string {
+	serviceRegexpLock.RLock()
+	defer serviceRegexpLock.RUnlock()
+	return serviceRegexp.FindStringSubmatch(key)
+}
+
 func (s *Location) Equals(other *Location) bool {
 	if s == nil && other == nil {
 		return true
@@ -39,16 +49,23 @@ func (s *Location) IsFullyDefined() bool {
 	return s.Host != "" && s.Port != 0
 }
 
-func getEnvIndexForNode(node *etcd.Node) string {
-	return strings.Split(serviceRegexp.FindStringSubmatch(node.Key)[1], "/")[1]
+func getEnvIndexForNode(node *Node) string {
+	return strings.Split(matchServiceRegexp(node.Key)[1], "/")[1]
 }
 
-func getEnvForNode(node *etcd.Node) string {
-	return strings.Split(serviceRegexp.FindStringSubmatch(node.Key)[1], "/")[0]
+func getEnvForNode(node *Node) string {
+	return strings.Split(matchServiceRegexp(node.Key)[1], "/")[0]
 }
 
+// Weight of the instances without one in their config.
+const DefaultWeight = 1
+
 type ServiceConfig struct {
 	Robots string `json:"robots"`
+	// Share of the traffic of the cluster routed to the instance, relatively
+	// to the other instances. 0 keeps the instance registered without routing
+	// new traffic to it. DefaultWeight if not set.
+	Weight *int `json:"weight,omitempty"`
 }
 
 func (config *ServiceConfig) Equals(other *ServiceConfig) bool {
@@ -57,7 +74,20 @@ func (config *ServiceConfig) Equals(other *ServiceConfig) bool {
 	}
 
 	return config != nil && other != nil &&
-		config.Robots == other.Robots
+		config.Robots == other.Robots &&
+		config.GetWeight() == other.GetWeight()
+}
+
+// GetWeight returns the weight of the instance, DefaultWeight if it is not
+// set. Negative weights count as 0.
+func (config *ServiceConfig) GetWeight() int {
+	if config == nil || config.Weight == nil {
+		return DefaultWeight
+	}
+	if *config.Weight < 0 {
+		return 0
+	}
+	return *config.Weight
 }
 
 type Service struct {
@@ -72,7 +102,7 @@ type Service struct {
 	log        *logrus.Logger
 }
 
-func NewService(serviceNode *etcd.Node) (*Service, error) {
+func NewService(serviceNode *Node) (*Service, error) {
 
 	serviceIndex := getEnvIndexForNode(serviceNode)
 
@@ -92,35 +122,20 @@ func NewService(serviceNode *etcd.Node) (*Service, error) {
 	for _, node := range serviceNode.Nodes {
 		switch node.Key {
 		case service.NodeKey + "/location":
-			location := &Location{}
-			err := json.Unmarshal([]byte(node.Value), location)
-			if err == nil {
-				service.Location.Host = location.Host
-				service.Location.Port = location.Port
-			}
+			service.setLocation(node.Value)
 
 		case service.NodeKey + "/config":
 			for _, subNode := range node.Nodes {
 				switch subNode.Key {
 				case service.NodeKey + "/config/gogeta":
-					serviceConfig := &ServiceConfig{}
-					err := json.Unmarshal([]byte(subNode.Value), serviceConfig)
-					if err == nil {
-						service.Config = serviceConfig
-					}
+					service.setConfig(subNode.Value)
 				}
 			}
 
 		case service.NodeKey + "/domain":
 			service.Domain = node.Value
 		case service.NodeKey + "/lastAccess":
-			lastAccess := node.Value
-			lastAccessTime, err := time.Parse(TIME_FORMAT, lastAccess)
-			if err != nil {
-				glog.Errorf("Error parsing last access date with service %s: %s", service.Name, err)
-				break
-			}
-			service.LastAccess = &lastAccessTime
+			service.setLastAccess(node.Value)
 
 		case service.NodeKey + "/status":
 			service.Status = NewStatus(service, node)
@@ -129,6 +144,48 @@ func NewService(serviceNode *etcd.Node) (*Service, error) {
 	return service, nil
 }
 
+func (service *Service) setLocation(value string) {
+	location := &Location{}
+	err := json.Unmarshal([]byte(value), location)
+	if err == nil {
+		service.Location.Host = location.Host
+		service.Location.Port = location.Port
+	}
+}
+
+func (service *Service) setConfig(value string) {
+	serviceConfig := &ServiceConfig{}
+	err := json.Unmarshal([]byte(value), serviceConfig)
+	if err == nil {
+		service.Config = serviceConfig
+	}
+}
+
+func (service *Service) setLastAccess(value string) {
+	lastAccessTime, err := time.Parse(TIME_FORMAT, value)
+	if err != nil {
+		glog.Errorf("Error parsing last access date with service %s: %s", service.Name, err)
+		return
+	}
+	service.LastAccess = &lastAccessTime
+}
+
+// Returns a copy of the service, that can be modified without changing the
+// service.
+func (service *Service) copy() *Service {
+	c := *service
+	if service.Location != nil {
+		location := *service.Location
+		c.Location = &location
+	}
+	if service.Status != nil {
+		status := *service.Status
+		status.Service = &c
+		c.Status = &status
+	}
+	return &c
+}
+
 func (s *Service) UnitName() string {
 	return "nxio@" + strings.Split(s.Name, "_")[1] + ".service"
 }
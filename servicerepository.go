@@ -0,0 +1,278 @@
+package goarken
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A ConflictError is returned when a key of a service has been modified by
+// another writer since the service was read.
+type ConflictError struct {
+	Key string
+}
+
+func (e *ConflictError) Error() string {
+	return "Conflict while writing " + e.Key + ": it has been modified concurrently"
+}
+
+// Unwrap makes a ConflictError match ErrCompareFailed.
+func (e *ConflictError) Unwrap() error {
+	return ErrCompareFailed
+}
+
+// A ServiceRepository writes service instances to a backend, with the key
+// layout and the encoding read by NewService.
+//
+// Every write compares the stored value with the one of the service passed
+// in, and swaps it only if it is unchanged. A ConflictError is returned
+// otherwise, the service has then to be read again. Updated copies of the
+// services are returned, the services passed in are not modified.
+type ServiceRepository struct {
+	Client Backend
+	// Prefix of the services, /services by default.
+	Prefix string
+}
+
+func NewServiceRepository(client Backend, prefix string) *ServiceRepository {
+	return &ServiceRepository{Client: client, Prefix: prefix}
+}
+
+// Create writes a new service instance, identified by its Name and Index.
+// Its keys are written in a single transaction when the backend is a
+// TxnBackend. Otherwise, if one of them can't be written, the ones already
+// written are removed. The alive status is not written: it is owned by the
+// Heartbeat of the instance, which keeps it with a TTL.
+func (r *ServiceRepository) Create(service *Service) (*Service, error) {
+	if service.Name == "" || strings.Contains(service.Name, "/") {
+		return nil, fmt.Errorf("Invalid service name: %q", service.Name)
+	}
+	if _, err := strconv.Atoi(service.Index); err != nil {
+		return nil, fmt.Errorf("Invalid index of service %s: %q", service.Name, service.Index)
+	}
+
+	created := service.copy()
+	created.NodeKey = r.prefix() + "/" + service.Name + "/" + service.Index
+	// Like the services read by NewService
+	if created.Location == nil {
+		created.Location = &Location{}
+	}
+	if created.Config == nil {
+		created.Config = &ServiceConfig{Robots: ""}
+	}
+	if created.Status != nil {
+		created.Status.Alive = ""
+	}
+
+	if _, err := r.Client.Get(created.NodeKey, false); err != ErrKeyNotFound {
+		if err == nil {
+			return nil, &ConflictError{Key: created.NodeKey}
+		}
+		return nil, err
+	}
+
+	leaves := make(map[string]string)
+	flattenService(leaves, created.NodeKey, created)
+	keys := make([]string, 0, len(leaves))
+	for key := range leaves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if client, ok := r.Client.(TxnBackend); ok {
+		ops := make([]*TxnOp, 0, len(keys))
+		for _, key := range keys {
+			ops = append(ops, &TxnOp{Key: key, Value: leaves[key], Create: true})
+		}
+		if _, err := client.Txn(ops); err != nil {
+			return nil, conflict(created.NodeKey, err)
+		}
+		return created, nil
+	}
+
+	for i, key := range keys {
+		if _, err := r.Client.Create(key, leaves[key], 0); err != nil {
+			// Only the keys created here are removed
+			for _, written := range keys[:i] {
+				r.Client.Delete(written, false)
+			}
+			return nil, conflict(key, err)
+		}
+	}
+	return created, nil
+}
+
+// Get reads a service instance again, e.g. after a ConflictError.
+func (r *ServiceRepository) Get(service *Service) (*Service, error) {
+	response, err := r.Client.Get(r.instanceKey(service), true)
+	if err != nil {
+		return nil, err
+	}
+	return NewService(response.Node)
+}
+
+// UpdateLocation sets the location of a service instance.
+func (r *ServiceRepository) UpdateLocation(service *Service, location *Location) (*Service, error) {
+	if location == nil {
+		location = &Location{}
+	}
+	value, err := json.Marshal(location)
+	if err != nil {
+		return nil, err
+	}
+
+	unchanged := func(actual string) bool {
+		stored := &Location{}
+		if actual != "" {
+			json.Unmarshal([]byte(actual), stored)
+		}
+		known := service.Location
+		if known == nil {
+			known = &Location{}
+		}
+		return stored.Equals(known)
+	}
+
+	if err := r.swap(service, "location", string(value), unchanged); err != nil {
+		return nil, err
+	}
+
+	updated := service.copy()
+	updated.Location = &Location{Host: location.Host, Port: location.Port}
+	return updated, nil
+}
+
+// SetExpectedStatus sets the status expected for a service instance.
+func (r *ServiceRepository) SetExpectedStatus(service *Service, status string) (*Service, error) {
+	var known string
+	if service.Status != nil {
+		known = service.Status.Expected
+	}
+	if err := r.swap(service, "status/expected", status, sameValue(known)); err != nil {
+		return nil, err
+	}
+
+	updated := service.copy()
+	serviceStatus(updated).Expected = status
+	return updated, nil
+}
+
+// SetCurrentStatus sets the current status of a service instance.
+func (r *ServiceRepository) SetCurrentStatus(service *Service, status string) (*Service, error) {
+	var known string
+	if service.Status != nil {
+		known = service.Status.Current
+	}
+	if err := r.swap(service, "status/current", status, sameValue(known)); err != nil {
+		return nil, err
+	}
+
+	updated := service.copy()
+	serviceStatus(updated).Current = status
+	return updated, nil
+}
+
+// TouchLastAccess sets the last access time of a service instance.
+func (r *ServiceRepository) TouchLastAccess(service *Service, lastAccess time.Time) (*Service, error) {
+	var known string
+	if service.LastAccess != nil {
+		known = service.LastAccess.Format(TIME_FORMAT)
+	}
+	value := lastAccess.Format(TIME_FORMAT)
+	if err := r.swap(service, "lastAccess", value, sameValue(known)); err != nil {
+		return nil, err
+	}
+
+	updated := service.copy()
+	updated.LastAccess = nil
+	updated.setLastAccess(value)
+	return updated, nil
+}
+
+// SetConfig sets the configuration of a service instance.
+func (r *ServiceRepository) SetConfig(service *Service, config *ServiceConfig) (*Service, error) {
+	if config == nil {
+		config = &ServiceConfig{}
+	}
+	value, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	unchanged := func(actual string) bool {
+		stored := &ServiceConfig{}
+		if actual != "" {
+			json.Unmarshal([]byte(actual), stored)
+		}
+		known := service.Config
+		if known == nil {
+			known = &ServiceConfig{}
+		}
+		return stored.Equals(known)
+	}
+
+	if err := r.swap(service, "config/gogeta", string(value), unchanged); err != nil {
+		return nil, err
+	}
+
+	updated := service.copy()
+	c := *config
+	updated.Config = &c
+	return updated, nil
+}
+
+// Writes value at the field key of a service instance if unchanged accepts
+// the stored value, empty when the key does not exist.
+func (r *ServiceRepository) swap(service *Service, field string, value string, unchanged func(actual string) bool) error {
+	key := r.instanceKey(service) + "/" + field
+
+	response, err := r.Client.Get(key, false)
+	switch {
+	case err == ErrKeyNotFound:
+		if !unchanged("") {
+			return &ConflictError{Key: key}
+		}
+		_, err = r.Client.Create(key, value, 0)
+	case err != nil:
+		return err
+	case response.Node.Dir:
+		return fmt.Errorf("Not a file: %s", key)
+	default:
+		if !unchanged(response.Node.Value) {
+			return &ConflictError{Key: key}
+		}
+		_, err = r.Client.CompareAndSwap(key, value, 0, "", response.Node.ModifiedIndex)
+	}
+	return conflict(key, err)
+}
+
+func (r *ServiceRepository) instanceKey(service *Service) string {
+	if service.NodeKey != "" {
+		return service.NodeKey
+	}
+	return r.prefix() + "/" + service.Name + "/" + service.Index
+}
+
+func (r *ServiceRepository) prefix() string {
+	if r.Prefix == "" {
+		return "/services"
+	}
+	return r.Prefix
+}
+
+func sameValue(known string) func(actual string) bool {
+	return func(actual string) bool {
+		return actual == known
+	}
+}
+
+// Turns the errors of a concurrent write into a ConflictError.
+func conflict(key string, err error) error {
+	if err == ErrKeyExists || err == ErrCompareFailed || err == ErrKeyNotFound {
+		return &ConflictError{Key: key}
+	}
+	return err
+}
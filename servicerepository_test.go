@@ -0,0 +1,177 @@
+package goarken
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ServiceRepository(t *testing.T) {
+	var client *MemoryBackend
+	var repository *ServiceRepository
+
+	Convey("Given a service repository", t, func() {
+		client = NewMemoryBackend()
+		repository = NewServiceRepository(client, "")
+
+		Convey("When an instance is created", func() {
+			lastAccess := time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC)
+			service, err := repository.Create(&Service{
+				Name:       "my_service",
+				Index:      "1",
+				Domain:     "mydomain.com",
+				Location:   &Location{Host: "127.0.0.1", Port: 8080},
+				Status:     &Status{Current: STOPPED_STATUS, Expected: STARTED_STATUS},
+				LastAccess: &lastAccess,
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then it can be read back", func() {
+				So(service.NodeKey, ShouldEqual, "/services/my_service/1")
+
+				response, err := client.Get(service.NodeKey, true)
+				So(err, ShouldBeNil)
+				read, err := NewService(response.Node)
+				So(err, ShouldBeNil)
+				So(read.Equals(service), ShouldBeTrue)
+				So(read.Domain, ShouldEqual, "mydomain.com")
+				So(read.LastAccess.Equal(lastAccess), ShouldBeTrue)
+			})
+
+			Convey("Then it can't be created again", func() {
+				_, err := repository.Create(&Service{Name: "my_service", Index: "1"})
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+			})
+
+			Convey("Then its keys are written at the same index", func() {
+				response, _ := client.Get(service.NodeKey, true)
+				So(response.Node.Nodes[0].ModifiedIndex, ShouldEqual, response.Node.ModifiedIndex)
+				So(response.Node.Nodes[1].ModifiedIndex, ShouldEqual, response.Node.ModifiedIndex)
+			})
+
+			Convey("Then its status can be set", func() {
+				updated, err := repository.SetCurrentStatus(service, STARTING_STATUS)
+				So(err, ShouldBeNil)
+				So(updated.Status.Current, ShouldEqual, STARTING_STATUS)
+				So(service.Status.Current, ShouldEqual, STOPPED_STATUS)
+
+				updated, err = repository.SetExpectedStatus(updated, PASSIVATED_STATUS)
+				So(err, ShouldBeNil)
+
+				response, _ := client.Get("/services/my_service/1/status/current", false)
+				So(response.Node.Value, ShouldEqual, STARTING_STATUS)
+				response, _ = client.Get("/services/my_service/1/status/expected", false)
+				So(response.Node.Value, ShouldEqual, PASSIVATED_STATUS)
+			})
+
+			Convey("Then its location, config and last access can be set", func() {
+				updated, err := repository.UpdateLocation(service, &Location{Host: "10.0.0.1", Port: 80})
+				So(err, ShouldBeNil)
+				updated, err = repository.SetConfig(updated, &ServiceConfig{Robots: "noindex"})
+				So(err, ShouldBeNil)
+				updated, err = repository.TouchLastAccess(updated, lastAccess.Add(time.Hour))
+				So(err, ShouldBeNil)
+
+				response, _ := client.Get(service.NodeKey, true)
+				read, _ := NewService(response.Node)
+				So(read.Location.Host, ShouldEqual, "10.0.0.1")
+				So(read.Config.Robots, ShouldEqual, "noindex")
+				So(read.LastAccess.Equal(lastAccess.Add(time.Hour)), ShouldBeTrue)
+				So(read.Equals(updated), ShouldBeTrue)
+			})
+
+			Convey("Then a write based on a stale read is rejected", func() {
+				_, err := repository.SetCurrentStatus(service, STARTING_STATUS)
+				So(err, ShouldBeNil)
+
+				_, err = repository.SetCurrentStatus(service, STOPPING_STATUS)
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+				So(errors.Is(err, ErrCompareFailed), ShouldBeTrue)
+
+				response, _ := client.Get("/services/my_service/1/status/current", false)
+				So(response.Node.Value, ShouldEqual, STARTING_STATUS)
+
+				read, err := repository.Get(service)
+				So(err, ShouldBeNil)
+				So(read.Status.Current, ShouldEqual, STARTING_STATUS)
+				_, err = repository.SetCurrentStatus(read, STOPPING_STATUS)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When a missing key of an instance is set", func() {
+			service, _ := repository.Create(&Service{Name: "my_service", Index: "1", Domain: "mydomain.com"})
+			updated, err := repository.SetConfig(service, &ServiceConfig{Robots: "noindex"})
+
+			Convey("Then it is created", func() {
+				So(err, ShouldBeNil)
+				So(updated.Config.Robots, ShouldEqual, "noindex")
+				response, err := client.Get("/services/my_service/1/config/gogeta", false)
+				So(err, ShouldBeNil)
+				So(response.Action, ShouldEqual, "get")
+			})
+		})
+
+		Convey("When an instance has an invalid index", func() {
+			_, err := repository.Create(&Service{Name: "my_service", Index: "config"})
+
+			Convey("Then it is not created", func() {
+				So(err, ShouldNotBeNil)
+				_, err := client.Get("/services/my_service", true)
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+		})
+	})
+}
+
+// A backend without transactions, on which the current status of an
+// instance is created by someone else right before it is written.
+type concurrentServiceBackend struct {
+	Backend
+}
+
+func (b *concurrentServiceBackend) Create(key string, value string, ttl uint64) (*Response, error) {
+	if strings.HasSuffix(key, "/status/current") {
+		b.Backend.Create(key, STARTED_STATUS, 0)
+	}
+	return b.Backend.Create(key, value, ttl)
+}
+
+func Test_ServiceRepositoryCreate(t *testing.T) {
+	Convey("Given a service repository", t, func() {
+		client := NewMemoryBackend()
+
+		Convey("When an instance is created with an alive status", func() {
+			service, err := NewServiceRepository(client, "").Create(&Service{
+				Name:   "my_service",
+				Index:  "1",
+				Status: &Status{Alive: "1", Current: STARTED_STATUS, Expected: STARTED_STATUS},
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then the alive status is left to its heartbeat", func() {
+				So(service.Status.Alive, ShouldBeEmpty)
+				_, err := client.Get("/services/my_service/1/status/alive", false)
+				So(err, ShouldEqual, ErrKeyNotFound)
+			})
+		})
+
+		Convey("When an instance is created concurrently on a backend without transactions", func() {
+			_, err := NewServiceRepository(&concurrentServiceBackend{client}, "").Create(&Service{
+				Name:     "my_service",
+				Index:    "1",
+				Domain:   "mydomain.com",
+				Location: &Location{Host: "127.0.0.1", Port: 8080},
+				Status:   &Status{Current: STOPPED_STATUS, Expected: STARTED_STATUS},
+			})
+
+			Convey("Then a conflict is returned and only the keys it wrote are removed", func() {
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+				leaves, _ := readLeaves(client, "/services")
+				So(leaves, ShouldResemble, map[string]string{"/services/my_service/1/status/current": STARTED_STATUS})
+			})
+		})
+	})
+}
@@ -0,0 +1,270 @@
+package goarken
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+// Version of the snapshot format written by this package.
+const SnapshotVersion = 1
+
+// A Snapshot is a copy of the whole model, that can be written as JSON and
+// restored into a backend.
+type Snapshot struct {
+	Version  int                   `json:"version"`
+	Created  time.Time             `json:"created"`
+	Domains  map[string]*Domain    `json:"domains"`
+	Services map[string][]*Service `json:"services"`
+}
+
+// Snapshot returns a copy of the Domains and Services known to the Watcher.
+func (w *Watcher) Snapshot() *Snapshot {
+	snapshot := &Snapshot{
+		Version:  SnapshotVersion,
+		Created:  time.Now().UTC(),
+		Domains:  make(map[string]*Domain),
+		Services: make(map[string][]*Service),
+	}
+	w.EachDomain(func(name string, domain *Domain) {
+		snapshot.Domains[name] = domain
+	})
+	w.EachServiceCluster(func(name string, cluster *ServiceCluster) {
+		snapshot.Services[name] = cluster.GetInstances()
+	})
+	return snapshot
+}
+
+// WriteTo writes the snapshot as an indented JSON document.
+func (s *Snapshot) WriteTo(writer io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := writer.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// ReadSnapshot reads a JSON snapshot written by WriteTo.
+func ReadSnapshot(reader io.Reader) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	if err := json.NewDecoder(reader).Decode(snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != SnapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version %d, expected %d", snapshot.Version, SnapshotVersion)
+	}
+	for name, instances := range snapshot.Services {
+		for _, service := range instances {
+			service.Name = name
+			if service.Status != nil {
+				service.Status.Service = service
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// RestoreOptions configure RestoreSnapshot.
+type RestoreOptions struct {
+	// Prefixes to restore the snapshot to, /domains and /services by default.
+	DomainPrefix  string
+	ServicePrefix string
+	// Compute the changes without writing them.
+	DryRun bool
+	// Delete the domains, services, and their keys that are not in the
+	// snapshot.
+	Prune bool
+}
+
+// A Change of the backend made by RestoreSnapshot.
+type Change struct {
+	// "set" or "delete"
+	Action    string
+	Key       string
+	Value     string
+	PrevValue string
+}
+
+func (c *Change) String() string {
+	switch {
+	case c.Action == "delete":
+		return "- " + c.Key
+	case c.PrevValue == "":
+		return "+ " + c.Key + " = " + c.Value
+	default:
+		return "~ " + c.Key + " = " + c.Value + " (was " + c.PrevValue + ")"
+	}
+}
+
+// RestoreSnapshot writes the snapshot into the backend and returns the
+// changes it made, deletions first. In dry-run mode, the changes are only
+// computed, which gives the diff between the backend and the snapshot.
+// Alive keys are neither restored nor pruned: they are kept with their TTL by
+// the heartbeats of the instances.
+func RestoreSnapshot(client Backend, snapshot *Snapshot, options RestoreOptions) ([]*Change, error) {
+	if options.DomainPrefix == "" {
+		options.DomainPrefix = "/domains"
+	}
+	if options.ServicePrefix == "" {
+		options.ServicePrefix = "/services"
+	}
+
+	var changes []*Change
+	for _, prefix := range []string{options.DomainPrefix, options.ServicePrefix} {
+		actual, err := readLeaves(client, prefix)
+		if err != nil {
+			return nil, err
+		}
+		expected := flattenSnapshot(snapshot, prefix, options)
+		for _, leaves := range []map[string]string{actual, expected} {
+			for key := range leaves {
+				if path.Base(key) == "alive" && path.Base(path.Dir(key)) == "status" {
+					delete(leaves, key)
+				}
+			}
+		}
+		changes = append(changes, diffLeaves(prefix, actual, expected, options.Prune)...)
+	}
+
+	if options.DryRun {
+		return changes, nil
+	}
+
+	for _, change := range changes {
+		var err error
+		if change.Action == "delete" {
+			_, err = client.Delete(change.Key, true)
+		} else {
+			_, err = client.Set(change.Key, change.Value, 0)
+		}
+		if err != nil && err != ErrKeyNotFound {
+			return changes, fmt.Errorf("Unable to %s %s: %v", change.Action, change.Key, err)
+		}
+	}
+	return changes, nil
+}
+
+// Returns the keys and values of the snapshot under prefix.
+func flattenSnapshot(snapshot *Snapshot, prefix string, options RestoreOptions) map[string]string {
+	leaves := make(map[string]string)
+
+	switch prefix {
+	case options.DomainPrefix:
+		for name, domain := range snapshot.Domains {
+			leaves[prefix+"/"+name+"/type"] = domain.Typ
+			leaves[prefix+"/"+name+"/value"] = domain.Value
+		}
+
+	case options.ServicePrefix:
+		for name, instances := range snapshot.Services {
+			for _, service := range instances {
+				flattenService(leaves, prefix+"/"+name+"/"+service.Index, service)
+			}
+		}
+	}
+	return leaves
+}
+
+func flattenService(leaves map[string]string, key string, service *Service) {
+	set := func(field string, value string) {
+		if value != "" {
+			leaves[key+"/"+field] = value
+		}
+	}
+
+	set("domain", service.Domain)
+	if service.Location != nil && (service.Location.Host != "" || service.Location.Port != 0) {
+		location, _ := json.Marshal(service.Location)
+		set("location", string(location))
+	}
+	if service.Status != nil {
+		set("status/alive", service.Status.Alive)
+		set("status/current", service.Status.Current)
+		set("status/expected", service.Status.Expected)
+	}
+	if service.LastAccess != nil {
+		set("lastAccess", service.LastAccess.Format(TIME_FORMAT))
+	}
+	if service.Config != nil && !service.Config.Equals(&ServiceConfig{}) {
+		config, _ := json.Marshal(service.Config)
+		set("config/gogeta", string(config))
+	}
+}
+
+// Returns every key and value under prefix.
+func readLeaves(client Backend, prefix string) (map[string]string, error) {
+	leaves := make(map[string]string)
+
+	response, err := client.Get(prefix, true)
+	if err == ErrKeyNotFound {
+		return leaves, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		if !node.Dir {
+			leaves[node.Key] = node.Value
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(response.Node)
+	return leaves, nil
+}
+
+// Computes the changes turning actual into expected. When pruning, the
+// objects missing from expected are deleted as a whole.
+func diffLeaves(prefix string, actual map[string]string, expected map[string]string, prune bool) []*Change {
+	var deletions, sets []*Change
+
+	if prune {
+		// Directories of the objects still expected, like
+		// /services/my_service and /services/my_service/1
+		kept := make(map[string]bool)
+		for key := range expected {
+			for dir := path.Dir(key); dir != prefix && dir != "/"; dir = path.Dir(dir) {
+				kept[dir] = true
+			}
+		}
+
+		deleted := make(map[string]bool)
+		for key := range actual {
+			if _, ok := expected[key]; ok {
+				continue
+			}
+			// Delete the topmost directory that is not kept anymore
+			target := key
+			for dir := path.Dir(key); dir != prefix && dir != "/" && !kept[dir]; dir = path.Dir(dir) {
+				target = dir
+			}
+			if !deleted[target] {
+				deleted[target] = true
+				deletions = append(deletions, &Change{Action: "delete", Key: target, PrevValue: actual[target]})
+			}
+		}
+	}
+
+	for key, value := range expected {
+		if prev, ok := actual[key]; !ok || prev != value {
+			sets = append(sets, &Change{Action: "set", Key: key, Value: value, PrevValue: prev})
+		}
+	}
+
+	sort.Sort(changesByKey(deletions))
+	sort.Sort(changesByKey(sets))
+	return append(deletions, sets...)
+}
+
+type changesByKey []*Change
+
+func (c changesByKey) Len() int           { return len(c) }
+func (c changesByKey) Less(i, j int) bool { return c[i].Key < c[j].Key }
+func (c changesByKey) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,123 @@
+package goarken
+
+import (
+	"bytes"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func Test_Snapshot(t *testing.T) {
+	var w *Watcher
+	var client *MemoryBackend
+
+	Convey("Given a Watcher on a model", t, func() {
+		client = NewMemoryBackend()
+		client.Set("/domains/mydomain.com/type", "service", 0)
+		client.Set("/domains/mydomain.com/value", "my_service", 0)
+		client.Set("/services/my_service/1/domain", "mydomain.com", 0)
+		client.Set("/services/my_service/1/location", `{"host":"127.0.0.1","port":8080}`, 0)
+		client.Set("/services/my_service/1/status/current", STARTED_STATUS, 0)
+		client.Set("/services/my_service/1/status/expected", STARTED_STATUS, 0)
+		client.Set("/services/my_service/1/lastAccess", "2015-01-01 00:00:00", 0)
+		client.Set("/services/my_service/1/config/gogeta", `{"robots":"noindex"}`, 0)
+
+		w = &Watcher{
+			Client:        client,
+			DomainPrefix:  "/domains",
+			ServicePrefix: "/services",
+			Domains:       make(map[string]*Domain),
+			Services:      make(map[string]*ServiceCluster),
+		}
+		w.Start(context.Background())
+		Reset(w.Stop)
+		So(w.WaitForSync(context.Background()), ShouldBeNil)
+
+		Convey("When a snapshot is written and read back", func() {
+			var buffer bytes.Buffer
+			_, err := w.Snapshot().WriteTo(&buffer)
+			So(err, ShouldBeNil)
+			snapshot, err := ReadSnapshot(&buffer)
+			So(err, ShouldBeNil)
+
+			Convey("Then it contains the whole model", func() {
+				So(snapshot.Version, ShouldEqual, SnapshotVersion)
+				So(snapshot.Domains["mydomain.com"].Value, ShouldEqual, "my_service")
+				service := snapshot.Services["my_service"][0]
+				So(service.Location.Port, ShouldEqual, 8080)
+				So(service.Status.Current, ShouldEqual, STARTED_STATUS)
+				So(service.Status.Service, ShouldEqual, service)
+				So(service.Config.Robots, ShouldEqual, "noindex")
+				So(service.LastAccess, ShouldNotBeNil)
+			})
+
+			Convey("Then it can be restored into another backend", func() {
+				target := NewMemoryBackend()
+				changes, err := RestoreSnapshot(target, snapshot, RestoreOptions{})
+				So(err, ShouldBeNil)
+				So(len(changes), ShouldEqual, 8)
+
+				// Nothing left to change
+				changes, err = RestoreSnapshot(target, snapshot, RestoreOptions{DryRun: true})
+				So(err, ShouldBeNil)
+				So(len(changes), ShouldEqual, 0)
+
+				cluster, err := GetServiceClusterFromPath("/services/my_service", target)
+				So(err, ShouldBeNil)
+				So(cluster.Get("1").Equals(w.GetServiceCluster("my_service").Get("1")), ShouldBeTrue)
+			})
+
+			Convey("Then a dry run gives the diff without writing", func() {
+				client.Set("/services/my_service/1/status/current", STOPPED_STATUS, 0)
+				client.Set("/services/other_service/1/domain", "other.com", 0)
+
+				changes, err := RestoreSnapshot(client, snapshot, RestoreOptions{DryRun: true, Prune: true})
+				So(err, ShouldBeNil)
+				So(len(changes), ShouldEqual, 2)
+				So(changes[0].String(), ShouldEqual, "- /services/other_service")
+				So(changes[1].String(), ShouldEqual, "~ /services/my_service/1/status/current = started (was stopped)")
+
+				response, _ := client.Get("/services/my_service/1/status/current", false)
+				So(response.Node.Value, ShouldEqual, STOPPED_STATUS)
+			})
+
+			Convey("Then restoring with pruning removes what is not in the snapshot", func() {
+				client.Set("/services/other_service/1/domain", "other.com", 0)
+				client.Set("/services/my_service/2/domain", "mydomain.com", 0)
+
+				_, err := RestoreSnapshot(client, snapshot, RestoreOptions{Prune: true})
+				So(err, ShouldBeNil)
+				_, err = client.Get("/services/other_service", true)
+				So(err, ShouldEqual, ErrKeyNotFound)
+				_, err = client.Get("/services/my_service/2", true)
+				So(err, ShouldEqual, ErrKeyNotFound)
+				_, err = client.Get("/services/my_service/1/domain", false)
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Then the alive keys are left to the heartbeats", func() {
+				snapshot.Services["my_service"][0].Status.Alive = "1"
+				target := NewMemoryBackend()
+				_, err := RestoreSnapshot(target, snapshot, RestoreOptions{})
+				So(err, ShouldBeNil)
+				_, err = target.Get("/services/my_service/1/status/alive", false)
+				So(err, ShouldEqual, ErrKeyNotFound)
+
+				client.Set("/services/my_service/1/status/alive", "1", 10)
+				changes, err := RestoreSnapshot(client, snapshot, RestoreOptions{Prune: true})
+				So(err, ShouldBeNil)
+				So(changes, ShouldBeEmpty)
+				response, _ := client.Get("/services/my_service/1/status/alive", false)
+				So(response.Node.TTL, ShouldBeGreaterThan, 0)
+			})
+		})
+
+		Convey("When a snapshot of another version is read", func() {
+			_, err := ReadSnapshot(bytes.NewBufferString(`{"version": 42}`))
+
+			Convey("Then it is rejected", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -1,6 +1,8 @@
 package goarken
 
-import "github.com/coreos/go-etcd/etcd"
+import (
+	"errors"
+)
 
 const (
 	STARTING_STATUS   = "starting"
@@ -20,7 +22,7 @@ type Status struct {
 	Service  *Service `json:"-"`
 }
 
-func NewStatus(service *Service, node *etcd.Node) *Status {
+func NewStatus(service *Service, node *Node) *Status {
 	status := &Status{}
 	statusKey := service.NodeKey + "/status"
 	status.Service = service
@@ -55,57 +57,87 @@ func (s *Status) Equals(other *Status) bool {
 		s.Expected == other.Expected
 }
 
+// Compute returns the status of a service instance derived from its
+// current and expected statuses, see Diagnose.
 func (s *Status) Compute() string {
+	return s.Diagnose().Status
+}
+
+// Transition moves the service instance of the status from a state to
+// another. Both stored statuses must still be the ones of the state from: if
+// another actor changed one of them, a ConflictError is returned and nothing
+// is left written. On a TxnBackend, both statuses are written in a single
+// transaction. Otherwise the expected then the current status are written
+// with CompareAndSwap, guarded by the values and indexes read before, and the
+// expected status is restored if the current one can't be written. Returns
+// the new status.
+func (s *Status) Transition(client Backend, from string, to string) (*Status, error) {
+	if !CanTransition(from, to) {
+		return nil, &TransitionError{From: from, To: to}
+	}
+	if s.Service == nil || s.Service.NodeKey == "" {
+		return nil, errors.New("Status of an unknown service instance")
+	}
 
-	if s != nil {
-		Alive := s.Alive
-		Expected := s.Expected
-		Current := s.Current
-		switch Current {
-		case STOPPED_STATUS:
-			if Expected == PASSIVATED_STATUS {
-				return PASSIVATED_STATUS
-			} else if Expected == STOPPED_STATUS {
-				return STOPPED_STATUS
-			} else {
-				return ERROR_STATUS
-			}
-		case PASSIVATED_STATUS:
-			if Expected == PASSIVATED_STATUS {
-				return PASSIVATED_STATUS
-			} else {
-				return WARNING_STATUS
-			}
-		case STARTING_STATUS:
-			if Expected == STARTED_STATUS {
-				return STARTING_STATUS
-			} else {
-				return ERROR_STATUS
-			}
-		case STARTED_STATUS:
-			if Alive != "" {
-				if Expected != STARTED_STATUS {
-					return WARNING_STATUS
-				}
-				return STARTED_STATUS
-			} else {
-				if Expected != STARTED_STATUS {
-					return WARNING_STATUS
-				}
-				return ERROR_STATUS
-			}
-		case STOPPING_STATUS:
-			if Expected == STOPPED_STATUS {
-				return STOPPED_STATUS
-			} else if Expected == PASSIVATED_STATUS {
-				return PASSIVATED_STATUS
-			} else {
-				return ERROR_STATUS
-			}
-			// N/A
-		default:
-			return ERROR_STATUS
+	statusKey := s.Service.NodeKey + "/status"
+	state, target := transitionStates[from], transitionStates[to]
+	if txnClient, ok := client.(TxnBackend); ok {
+		_, err := txnClient.Txn([]*TxnOp{
+			{Key: statusKey + "/current", Value: target.Current, PrevValue: state.Current},
+			{Key: statusKey + "/expected", Value: target.Expected, PrevValue: state.Expected},
+		})
+		if err != nil {
+			return nil, conflict(statusKey, err)
 		}
+	} else if err := swapStatus(client, statusKey, state, target); err != nil {
+		return nil, err
+	}
+
+	status := *s
+	status.Current = target.Current
+	status.Expected = target.Expected
+	return &status, nil
+}
+
+// Writes the statuses of target under statusKey if they still are the ones of
+// state, one after the other.
+func swapStatus(client Backend, statusKey string, state *Status, target *Status) error {
+	current, err := readStatusKey(client, statusKey+"/current")
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Value != state.Current {
+		return &ConflictError{Key: statusKey + "/current"}
+	}
+	expected, err := readStatusKey(client, statusKey+"/expected")
+	if err != nil {
+		return err
+	}
+	if expected == nil || expected.Value != state.Expected {
+		return &ConflictError{Key: statusKey + "/expected"}
+	}
+
+	response, err := client.CompareAndSwap(statusKey+"/expected", target.Expected, 0, expected.Value, expected.ModifiedIndex)
+	if err != nil {
+		return conflict(statusKey+"/expected", err)
+	}
+	_, err = client.CompareAndSwap(statusKey+"/current", target.Current, 0, current.Value, current.ModifiedIndex)
+	if err != nil {
+		// Restore the expected status, unless it has been changed since
+		client.CompareAndSwap(statusKey+"/expected", expected.Value, 0, target.Expected, response.Node.ModifiedIndex)
+		return conflict(statusKey+"/current", err)
+	}
+	return nil
+}
+
+// Returns the node of key, nil if it does not exist.
+func readStatusKey(client Backend, key string) (*Node, error) {
+	response, err := client.Get(key, false)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
-	return NA_STATUS
+	return response.Node, nil
 }
@@ -2,6 +2,7 @@ package goarken
 
 import (
 	. "github.com/smartystreets/goconvey/convey"
+	"strings"
 	"testing"
 )
 
@@ -116,3 +117,124 @@ func Test_status(t *testing.T) {
 	})
 
 }
+
+func Test_StatusTransition(t *testing.T) {
+	var client *MemoryBackend
+	var status *Status
+
+	Convey("Given a stopped service instance", t, func() {
+		client = NewMemoryBackend()
+		client.Set("/services/my_service/1/status/current", STOPPED_STATUS, 0)
+		client.Set("/services/my_service/1/status/expected", STOPPED_STATUS, 0)
+		response, _ := client.Get("/services/my_service/1", true)
+		service, _ := NewService(response.Node)
+		status = service.Status
+
+		Convey("When it is started", func() {
+			started, err := status.Transition(client, STOPPED_STATUS, STARTING_STATUS)
+
+			Convey("Then both statuses are written", func() {
+				So(err, ShouldBeNil)
+				So(started.Current, ShouldEqual, STARTING_STATUS)
+				So(started.Expected, ShouldEqual, STARTED_STATUS)
+
+				response, _ := client.Get("/services/my_service/1/status/current", false)
+				So(response.Node.Value, ShouldEqual, STARTING_STATUS)
+				response, _ = client.Get("/services/my_service/1/status/expected", false)
+				So(response.Node.Value, ShouldEqual, STARTED_STATUS)
+			})
+		})
+
+		Convey("When it is moved to a state that is not reachable", func() {
+			_, err := status.Transition(client, STOPPED_STATUS, STARTED_STATUS)
+
+			Convey("Then the transition is rejected", func() {
+				So(err, ShouldResemble, &TransitionError{From: STOPPED_STATUS, To: STARTED_STATUS})
+			})
+		})
+
+		Convey("When another actor changed its current status first", func() {
+			client.Set("/services/my_service/1/status/current", STARTING_STATUS, 0)
+			_, err := status.Transition(client, STOPPED_STATUS, PASSIVATED_STATUS)
+
+			Convey("Then a conflict is returned", func() {
+				So(err, ShouldResemble, &ConflictError{Key: "/services/my_service/1/status"})
+
+				response, _ := client.Get("/services/my_service/1/status/expected", false)
+				So(response.Node.Value, ShouldEqual, STOPPED_STATUS)
+			})
+		})
+
+		Convey("When another actor changed its expected status first", func() {
+			client.Set("/services/my_service/1/status/expected", STARTED_STATUS, 0)
+			_, err := status.Transition(client, STOPPED_STATUS, PASSIVATED_STATUS)
+
+			Convey("Then a conflict is returned", func() {
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+
+				response, _ := client.Get("/services/my_service/1/status/current", false)
+				So(response.Node.Value, ShouldEqual, STOPPED_STATUS)
+			})
+
+			Convey("Then a conflict is returned even with the status read since", func() {
+				response, _ := client.Get("/services/my_service/1", true)
+				service, _ := NewService(response.Node)
+				_, err := service.Status.Transition(client, STOPPED_STATUS, PASSIVATED_STATUS)
+				So(err, ShouldHaveSameTypeAs, &ConflictError{})
+			})
+		})
+
+		Convey("When the status passed in is older than the stored one", func() {
+			status.Expected = ""
+			_, err := status.Transition(client, STOPPED_STATUS, PASSIVATED_STATUS)
+
+			Convey("Then the transition is checked against the stored state", func() {
+				So(err, ShouldBeNil)
+				response, _ := client.Get("/services/my_service/1/status/expected", false)
+				So(response.Node.Value, ShouldEqual, PASSIVATED_STATUS)
+			})
+		})
+
+		Convey("When the backend has no transactions", func() {
+			started, err := status.Transition(struct{ Backend }{client}, STOPPED_STATUS, STARTING_STATUS)
+
+			Convey("Then both statuses are written with compare and swap", func() {
+				So(err, ShouldBeNil)
+				So(started.Current, ShouldEqual, STARTING_STATUS)
+				response, _ := client.Get("/services/my_service/1/status", true)
+				So(response.Node.Nodes[0].Value, ShouldEqual, STARTING_STATUS)
+				So(response.Node.Nodes[1].Value, ShouldEqual, STARTED_STATUS)
+			})
+
+			Convey("Then a transition from a state that is not stored anymore is rejected", func() {
+				_, err := status.Transition(struct{ Backend }{client}, STOPPED_STATUS, PASSIVATED_STATUS)
+				So(err, ShouldResemble, &ConflictError{Key: "/services/my_service/1/status/current"})
+			})
+		})
+
+		Convey("When its current status changes while the expected one is written", func() {
+			_, err := status.Transition(&racingStatusBackend{client}, STOPPED_STATUS, STARTING_STATUS)
+
+			Convey("Then a conflict is returned and the expected status is restored", func() {
+				So(err, ShouldResemble, &ConflictError{Key: "/services/my_service/1/status/current"})
+				response, _ := client.Get("/services/my_service/1/status", true)
+				So(response.Node.Nodes[0].Value, ShouldEqual, PASSIVATED_STATUS)
+				So(response.Node.Nodes[1].Value, ShouldEqual, STOPPED_STATUS)
+			})
+		})
+	})
+}
+
+// A backend without transactions, on which another actor passivates the
+// instance when its expected status is swapped.
+type racingStatusBackend struct {
+	Backend
+}
+
+func (b *racingStatusBackend) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error) {
+	response, err := b.Backend.CompareAndSwap(key, value, ttl, prevValue, prevIndex)
+	if strings.HasSuffix(key, "/expected") && value == STARTED_STATUS {
+		b.Backend.Set(strings.TrimSuffix(key, "/expected")+"/current", PASSIVATED_STATUS, 0)
+	}
+	return response, err
+}